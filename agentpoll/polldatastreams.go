@@ -2,6 +2,7 @@
 package agentpoll
 import (
 	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/metrics"
 	"sync"
 	"log"
 	"time"
@@ -10,6 +11,9 @@ import (
 // An agent is considered offline if it doesn't send any data in this amount of time
 const offlineAgentInactivityTimeout = 30 * time.Second
 
+var requeuedCommands = metrics.NewCounter("agentcontroller_commands_requeued_total",
+	"Commands put back in an agent queue because the agent stopped polling before receiving them.")
+
 /*
 PollData Gets a chain for the caller to wait on, we return a chan chan string instead
 of chan string directly to make sure of the following:
@@ -111,6 +115,7 @@ func pollDataStreamLogic(
 
 		default:
 			// Agent did not receive this command.
+			requeuedCommands.Inc()
 			commandStorage.ReportUndeliveredCommand(agentID, &command)
 		}
 	}
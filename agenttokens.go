@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+)
+
+const (
+	//secretResultTTL is how long a secret result waits in the result queue of the client
+	secretResultTTL = 30 * time.Second
+
+	redactedResultData = `"redacted, delivered once through the result queue"`
+)
+
+//secretResult wraps the result of an internal command that must not be kept in redis, like an agent
+//token. The jobresult hash only gets a redacted copy.
+type secretResult struct {
+	value interface{}
+}
+
+type agentTokenRequest struct {
+	Gid *uint `json:"gid"`
+	Nid *uint `json:"nid"`
+}
+
+func parseAgentTokenRequest(cmd *core.Command) (core.AgentID, error) {
+	var request agentTokenRequest
+	if err := json.Unmarshal([]byte(cmd.Data), &request); err != nil {
+		return core.AgentID{}, err
+	}
+
+	if request.Gid == nil || request.Nid == nil {
+		return core.AgentID{}, errors.New("both gid and nid are required")
+	}
+
+	return core.AgentID{GID: *request.Gid, NID: *request.Nid}, nil
+}
+
+// Issues a new token for the Agent given as {"gid": x, "nid": y} in the command data, invalidating the old one.
+// The token is a secret result, the client has to wait for it on the result queue.
+func internalIssueAgentToken(cmd *core.Command) (interface{}, error) {
+	agentID, err := parseAgentTokenRequest(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := agentTokens.IssueToken(agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretResult{value: token}, nil
+}
+
+// Revokes the token of the Agent given as {"gid": x, "nid": y} in the command data
+func internalRevokeAgentToken(cmd *core.Command) (interface{}, error) {
+	agentID, err := parseAgentTokenRequest(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return agentTokens.RevokeToken(agentID)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/redisdata"
+	"github.com/amrhassan/agentcontroller2/retention"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAgentTokenRequest(t *testing.T) {
+
+	id, err := parseAgentTokenRequest(&core.Command{Data: `{"gid": 1, "nid": 2}`})
+	assert.NoError(t, err)
+	assert.Equal(t, core.AgentID{GID: 1, NID: 2}, id)
+
+	_, err = parseAgentTokenRequest(&core.Command{Data: `{"gid": 1}`})
+	assert.Error(t, err)
+
+	_, err = parseAgentTokenRequest(&core.Command{Data: `not json`})
+	assert.Error(t, err)
+}
+
+func TestIssuedAgentTokenIsNotKept(t *testing.T) {
+
+	fake := newFakeRedis()
+	pool := fake.pool()
+	redisData = redisdata.NewRedisData(pool)
+	agentTokens = redisData
+	keeper = retention.NewKeeper(pool, retention.Options{})
+
+	command := &core.Command{ID: "job", Gid: 1, Nid: 2, Cmd: cmdInternal, Data: `{"gid": 3, "nid": 4}`}
+	command.Args.Name = "agent_token_issue"
+	processInternalCommand(command)
+
+	queue := fake.lists["cmd.job.1.2"]
+	if assert.Len(t, queue, 1) {
+		delivered := &core.CommandResult{}
+		assert.NoError(t, json.Unmarshal([]byte(queue[0]), delivered))
+		assert.Equal(t, "SUCCESS", delivered.State)
+
+		var token string
+		assert.NoError(t, json.Unmarshal([]byte(delivered.Data), &token))
+		valid, err := agentTokens.VerifyToken(core.AgentID{GID: 3, NID: 4}, token)
+		assert.NoError(t, err)
+		assert.True(t, valid)
+
+		assert.NotContains(t, fake.hashes["jobresult:job"]["1:2"], token)
+		assert.NotContains(t, fake.hashes["agent.tokens"]["3:4"], token)
+	}
+	assert.Equal(t, int64(secretResultTTL.Seconds()), fake.ttls["cmd.job.1.2"])
+
+	stored := &core.CommandResult{}
+	assert.NoError(t, json.Unmarshal([]byte(fake.hashes["jobresult:job"]["1:2"]), stored))
+	assert.Equal(t, "SUCCESS", stored.State)
+	assert.True(t, strings.Contains(stored.Data, "redacted"))
+}
+
+func TestRevokeAgentToken(t *testing.T) {
+
+	redisData = redisdata.NewRedisData(newFakeRedis().pool())
+	agentTokens = redisData
+
+	id := core.AgentID{GID: 3, NID: 4}
+	token, err := agentTokens.IssueToken(id)
+	assert.NoError(t, err)
+
+	revoked, err := internalRevokeAgentToken(&core.Command{Data: `{"gid": 3, "nid": 4}`})
+	assert.NoError(t, err)
+	assert.Equal(t, true, revoked)
+
+	valid, err := agentTokens.VerifyToken(id, token)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+}
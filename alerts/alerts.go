@@ -0,0 +1,254 @@
+// Threshold alerts on the stats agents report
+package alerts
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/stats"
+)
+
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Series aren't forgotten sooner than that, so rules without a duration survive the time between two reports
+const minSeriesExpiry = time.Minute
+
+// Fires when a field of the measurements matching a glob pattern stays past a threshold for a while
+type Rule struct {
+	Name        string
+	Measurement string
+	// Field compared to the threshold, the legacy value field if empty
+	Field     string
+	Op        string
+	Threshold float64
+	For       time.Duration
+	// Remediation is an optional command dispatched to the offending agent when the rule fires
+	Remediation map[string]interface{}
+}
+
+func (rule *Rule) Validate() error {
+	if rule.Name == "" {
+		return fmt.Errorf("alert rule without a name")
+	}
+	if _, err := path.Match(rule.Measurement, ""); err != nil {
+		return fmt.Errorf("alert %s has an invalid measurement pattern %q: %v", rule.Name, rule.Measurement, err)
+	}
+	if _, ok := comparisons[rule.Op]; !ok {
+		return fmt.Errorf("alert %s has an unknown op %q, expected >, >=, <, <=, == or !=", rule.Name, rule.Op)
+	}
+	if rule.For < 0 {
+		return fmt.Errorf("alert %s has a negative duration", rule.Name)
+	}
+	return nil
+}
+
+func (rule *Rule) field() string {
+	if rule.Field == "" {
+		return stats.ValueField
+	}
+	return rule.Field
+}
+
+var comparisons = map[string]func(float64, float64) bool{
+	">":  func(value, threshold float64) bool { return value > threshold },
+	">=": func(value, threshold float64) bool { return value >= threshold },
+	"<":  func(value, threshold float64) bool { return value < threshold },
+	"<=": func(value, threshold float64) bool { return value <= threshold },
+	"==": func(value, threshold float64) bool { return value == threshold },
+	"!=": func(value, threshold float64) bool { return value != threshold },
+}
+
+// Emitted when a rule fires or resolves for a series
+type Event struct {
+	Rule        string            `json:"rule"`
+	State       string            `json:"state"`
+	Measurement string            `json:"measurement"`
+	Tags        map[string]string `json:"tags"`
+	Field       string            `json:"field"`
+	Value       float64           `json:"value"`
+	Op          string            `json:"op"`
+	Threshold   float64           `json:"threshold"`
+	// Since is the unix time the condition started to hold
+	Since int64 `json:"since"`
+	Time  int64 `json:"time"`
+	// The authenticated agent that reported the point, nil if unknown
+	Agent *core.AgentID `json:"-"`
+}
+
+// The state of a rule for a single series
+type series struct {
+	rule   *Rule
+	since  time.Time
+	firing bool
+	// The last point that held the condition, its value and when it was written
+	point stats.Point
+	value float64
+	seen  time.Time
+}
+
+/*
+Evaluates the rules on every point before writing them to the next sink. A rule fires for a series,
+a measurement and its tags, once its condition held for all the points of the series reported for
+its duration, and resolves with the first point for which it doesn't hold anymore. Series that
+aren't reported for the duration of their rule, or a minute if longer, are forgotten, and resolve
+if they were firing.
+*/
+type Evaluator struct {
+	sink   stats.Sink
+	rules  []Rule
+	notify func(*Rule, *Event)
+	now    func() time.Time
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+// Creates an Evaluator in front of sink, notify is called for every event
+func NewEvaluator(sink stats.Sink, rules []Rule, notify func(*Rule, *Event)) (*Evaluator, error) {
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Evaluator{
+		sink:   sink,
+		rules:  rules,
+		notify: notify,
+		now:    time.Now,
+		series: make(map[string]*series),
+	}, nil
+}
+
+func (evaluator *Evaluator) Write(points []stats.Point) error {
+	var events []*Event
+	var fired []*Rule
+
+	now := evaluator.now()
+
+	evaluator.lock.Lock()
+	for _, point := range points {
+		for i := range evaluator.rules {
+			rule := &evaluator.rules[i]
+			if event := evaluator.evaluate(rule, point, now); event != nil {
+				events = append(events, event)
+				fired = append(fired, rule)
+			}
+		}
+	}
+	for _, state := range evaluator.expire(now) {
+		events = append(events, newEvent(state.rule, state.point, StateResolved, state.value, state.since))
+		fired = append(fired, state.rule)
+	}
+	evaluator.lock.Unlock()
+
+	for i, event := range events {
+		evaluator.notify(fired[i], event)
+	}
+
+	return evaluator.sink.Write(points)
+}
+
+// Updates the state of the series of the point for a rule, must be called with the lock held
+func (evaluator *Evaluator) evaluate(rule *Rule, point stats.Point, now time.Time) *Event {
+	if matched, _ := path.Match(rule.Measurement, point.Measurement); !matched {
+		return nil
+	}
+
+	var value float64
+	switch v := point.Fields[rule.field()].(type) {
+	case float64:
+		value = v
+	case int64:
+		value = float64(v)
+	default:
+		return nil
+	}
+
+	key := seriesKey(rule, point)
+	state, ok := evaluator.series[key]
+
+	if !comparisons[rule.Op](value, rule.Threshold) {
+		if !ok {
+			return nil
+		}
+		delete(evaluator.series, key)
+		if !state.firing {
+			return nil
+		}
+		return newEvent(rule, point, StateResolved, value, state.since)
+	}
+
+	if !ok {
+		state = &series{rule: rule, since: point.Time}
+		evaluator.series[key] = state
+	}
+	state.point, state.value, state.seen = point, value, now
+
+	if state.firing || point.Time.Sub(state.since) < rule.For {
+		return nil
+	}
+
+	state.firing = true
+	return newEvent(rule, point, StateFiring, value, state.since)
+}
+
+// Forgets the series that weren't reported for long and returns those that were firing, the lock must be held
+func (evaluator *Evaluator) expire(now time.Time) []*series {
+	var resolved []*series
+	for key, state := range evaluator.series {
+		expiry := state.rule.For
+		if expiry < minSeriesExpiry {
+			expiry = minSeriesExpiry
+		}
+		if now.Sub(state.seen) <= expiry {
+			continue
+		}
+
+		delete(evaluator.series, key)
+		if state.firing {
+			//the series resolves now, as far as the controller can tell
+			state.point.Time = now
+			resolved = append(resolved, state)
+		}
+	}
+	return resolved
+}
+
+func newEvent(rule *Rule, point stats.Point, state string, value float64, since time.Time) *Event {
+	return &Event{
+		Rule:        rule.Name,
+		State:       state,
+		Measurement: point.Measurement,
+		Tags:        point.Tags,
+		Field:       rule.field(),
+		Value:       value,
+		Op:          rule.Op,
+		Threshold:   rule.Threshold,
+		Since:       since.Unix(),
+		Time:        point.Time.Unix(),
+		Agent:       point.Agent,
+	}
+}
+
+func seriesKey(rule *Rule, point stats.Point) string {
+	keys := make([]string, 0, len(point.Tags))
+	for key := range point.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{rule.Name, point.Measurement}
+	for _, key := range keys {
+		parts = append(parts, key+"="+point.Tags[key])
+	}
+	return strings.Join(parts, "\xff")
+}
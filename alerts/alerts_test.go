@@ -0,0 +1,65 @@
+package alerts_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/alerts"
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+type discardSink struct {
+	written int
+}
+
+func (sink *discardSink) Write(points []stats.Point) error {
+	sink.written += len(points)
+	return nil
+}
+
+func TestEvaluatorFiresAndResolves(t *testing.T) {
+
+	var events []*alerts.Event
+	sink := &discardSink{}
+	evaluator, err := alerts.NewEvaluator(sink, []alerts.Rule{{
+		Name:        "cpu-high",
+		Measurement: "*.*.monitor.cpu.percent",
+		Op:          ">",
+		Threshold:   90,
+		For:         5 * time.Minute,
+	}}, func(rule *alerts.Rule, event *alerts.Event) {
+		events = append(events, event)
+	})
+	assert.NoError(t, err)
+
+	start := time.Unix(1445000000, 0)
+	cpu := func(gid string, offset time.Duration, value float64) stats.Point {
+		key := gid + ".1.monitor.cpu.percent"
+		return stats.Point{Measurement: key, Time: start.Add(offset), Tags: stats.KeyTags(key),
+			Fields: map[string]interface{}{"value": value}}
+	}
+
+	evaluator.Write([]stats.Point{cpu("1", 0, 95), cpu("2", 0, 95)})
+	evaluator.Write([]stats.Point{cpu("1", 3*time.Minute, 99), cpu("2", 3*time.Minute, 50)})
+	assert.Empty(t, events)
+
+	evaluator.Write([]stats.Point{cpu("1", 5*time.Minute, 92), cpu("2", 5*time.Minute, 95)})
+	assert.Len(t, events, 1)
+	assert.Equal(t, alerts.StateFiring, events[0].State)
+	assert.Equal(t, "1", events[0].Tags["gid"])
+	assert.Equal(t, start.Unix(), events[0].Since)
+	assert.Equal(t, 92.0, events[0].Value)
+
+	evaluator.Write([]stats.Point{cpu("1", 6*time.Minute, 97)})
+	assert.Len(t, events, 1, "a firing rule doesn't fire again")
+
+	evaluator.Write([]stats.Point{cpu("1", 7*time.Minute, 10)})
+	assert.Len(t, events, 2)
+	assert.Equal(t, alerts.StateResolved, events[1].State)
+
+	assert.Equal(t, 8, sink.written)
+
+	_, err = alerts.NewEvaluator(sink, []alerts.Rule{{Name: "bad", Measurement: "cpu", Op: "~"}}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,60 @@
+package alerts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+type nullSink struct{}
+
+func (nullSink) Write(points []stats.Point) error {
+	return nil
+}
+
+func TestEvaluatorResolvesSeriesNoLongerReported(t *testing.T) {
+
+	var events []*Event
+	evaluator, err := NewEvaluator(nullSink{}, []Rule{{
+		Name:        "cpu-high",
+		Measurement: "*.*.monitor.cpu.percent",
+		Op:          ">",
+		Threshold:   90,
+		For:         5 * time.Minute,
+	}}, func(rule *Rule, event *Event) {
+		events = append(events, event)
+	})
+	assert.NoError(t, err)
+
+	clock := time.Unix(1445000000, 0)
+	evaluator.now = func() time.Time { return clock }
+	cpu := func(gid string, value float64) stats.Point {
+		key := gid + ".1.monitor.cpu.percent"
+		return stats.Point{Measurement: key, Time: clock, Tags: stats.KeyTags(key),
+			Fields: map[string]interface{}{"value": value}}
+	}
+
+	evaluator.Write([]stats.Point{cpu("1", 95), cpu("2", 95)})
+	clock = clock.Add(5 * time.Minute)
+	evaluator.Write([]stats.Point{cpu("1", 95)})
+	assert.Len(t, events, 1)
+	assert.Equal(t, StateFiring, events[0].State)
+	assert.Len(t, evaluator.series, 2)
+
+	//agent 2 went quiet for longer than the rule, its pending series is forgotten
+	clock = clock.Add(time.Minute)
+	evaluator.Write([]stats.Point{cpu("1", 95)})
+	assert.Len(t, events, 1)
+	assert.Len(t, evaluator.series, 1)
+
+	//agent 1 went quiet while firing, and resolves
+	clock = clock.Add(6 * time.Minute)
+	evaluator.Write([]stats.Point{cpu("3", 10)})
+	assert.Len(t, events, 2)
+	assert.Equal(t, StateResolved, events[1].State)
+	assert.Equal(t, "1", events[1].Tags["gid"])
+	assert.Equal(t, clock.Unix(), events[1].Time)
+	assert.Empty(t, evaluator.series)
+}
@@ -41,6 +41,7 @@ const (
 	cmdQueueCmdQueued     = "cmd.%s.queued"
 	cmdQueueAgentResponse = "cmd.%s.%d.%d"
 	hashCmdResults        = "jobresult:%s"
+	hashAgentKeys         = "agent.keys"
 )
 
 //TIMEOUT timeout error
@@ -72,6 +73,8 @@ type Command struct {
 	Data   string   `json:"data"`
 	Roles  []string `json:"roles"`
 	Fanout bool     `json:"fanout"`
+	//Encrypted makes the controller seal Data to the public key of each target agent
+	Encrypted bool `json:"encrypted"`
 }
 
 //CommandReference is an executed command
@@ -88,6 +91,7 @@ type RunArgs map[string]interface{}
 type Client interface {
 	Run(cmd *Command) (*CommandReference, error)
 	GetJobs(ID string, timeout int) ([]*Job, error)
+	AgentPublicKey(gid int, nid int) ([]byte, error)
 }
 
 //NewRunArgs creates a new run arguments
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/amrhassan/agentcontroller2/seal"
+	"github.com/garyburd/redigo/redis"
+)
+
+//AgentPublicKey returns the PEM encoded public key registered by an agent, or nil if it has none
+func (client *clientImpl) AgentPublicKey(gid int, nid int) ([]byte, error) {
+	db := client.redis.Get()
+	defer db.Close()
+
+	key, err := redis.Bytes(db.Do("HGET", hashAgentKeys, fmt.Sprintf("%d:%d", gid, nid)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	return key, err
+}
+
+//EncryptData seals data to a PEM encoded agent public key, as the controller does for encrypted commands
+func EncryptData(publicKeyPEM []byte, data string) (string, error) {
+	key, err := seal.ParsePublicKey(publicKeyPEM)
+	if err != nil {
+		return "", err
+	}
+
+	return seal.Seal(key, []byte(data))
+}
+
+//DecryptData opens data sealed to the public counterpart of key
+func DecryptData(key *rsa.PrivateKey, data string) (string, error) {
+	plain, err := seal.Open(key, data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
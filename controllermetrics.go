@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/amrhassan/agentcontroller2/metrics"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	agentQueue = "cmds:%d:%d"
+
+	//routing types of the dispatched commands
+	routingInternal = "internal"
+	routingAgent    = "gid_nid"
+	routingRole     = "role"
+	routingFanout   = "fanout"
+)
+
+var (
+	dispatchedCommands = metrics.NewCounter("agentcontroller_commands_dispatched_total",
+		"Commands read from cmds.queue, by routing type: internal, gid_nid, role or fanout.", "routing")
+	dispatchLatency = metrics.NewHistogram("agentcontroller_dispatch_latency_seconds",
+		"Time between reading a command from cmds.queue and queueing it for its agents.", metrics.LatencyBuckets)
+	schedulerFires = metrics.NewCounter("agentcontroller_scheduler_fires_total",
+		"Runs of scheduled jobs by result: pushed, skipped because of the concurrency policy, or error.", "result")
+)
+
+//installQueueMetrics reports the depth of the main commands queue and of the queues of the connected agents
+func installQueueMetrics(pool *redis.Pool) {
+	metrics.NewGaugeFunc("agentcontroller_commands_queue_depth",
+		"Commands waiting in cmds.queue to be dispatched.", nil, func() []metrics.Sample {
+			db := pool.Get()
+			defer db.Close()
+
+			depth, err := redis.Int(db.Do("LLEN", cmdQueueMain))
+			if err != nil {
+				log.Println("Failed to get the depth of", cmdQueueMain, err)
+				return nil
+			}
+			return []metrics.Sample{{Value: float64(depth)}}
+		})
+
+	metrics.NewGaugeFunc("agentcontroller_agent_queue_depth",
+		"Commands waiting for a connected agent to pick them up.", []string{"gid", "nid"}, func() []metrics.Sample {
+			agents := agentData.ConnectedAgents()
+
+			db := pool.Get()
+			defer db.Close()
+
+			for _, agent := range agents {
+				db.Send("LLEN", fmt.Sprintf(agentQueue, agent.GID, agent.NID))
+			}
+			if err := db.Flush(); err != nil {
+				log.Println("Failed to get the depth of the agent queues", err)
+				return nil
+			}
+
+			samples := make([]metrics.Sample, 0, len(agents))
+			for _, agent := range agents {
+				depth, err := redis.Int(db.Receive())
+				if err != nil {
+					log.Println("Failed to get the depth of the agent queues", err)
+					return nil
+				}
+				samples = append(samples, metrics.Sample{
+					Labels: []string{fmt.Sprint(agent.GID), fmt.Sprint(agent.NID)},
+					Value:  float64(depth),
+				})
+			}
+			return samples
+		})
+}
@@ -0,0 +1,11 @@
+package core
+
+// Public keys registered by Agents for receiving sealed command payloads
+type AgentKeyStorage interface {
+
+	// Sets the PEM-encoded public key of an Agent, replacing any previously registered one
+	SetPublicKey(id AgentID, key []byte) error
+
+	// Gets the PEM-encoded public key of an Agent, or nil if it hasn't registered one
+	PublicKey(id AgentID) ([]byte, error)
+}
@@ -0,0 +1,15 @@
+package core
+
+// Credentials that Agents authenticate themselves with on the Agent HTTP API
+type AgentTokenStorage interface {
+
+	// Issues a new token for an Agent, replacing any previously issued one.
+	// Only a hash of the token is kept, so the returned token can't be recovered later.
+	IssueToken(id AgentID) (string, error)
+
+	// Revokes the token of an Agent, returning false if it didn't have one
+	RevokeToken(id AgentID) (bool, error)
+
+	// Checks if the token is the one currently issued to the Agent
+	VerifyToken(id AgentID, token string) (bool, error)
+}
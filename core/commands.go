@@ -8,6 +8,10 @@ type Command struct {
 	Roles  []string `json:"roles"`
 	Fanout bool     `json:"fanout"`
 	Data   string   `json:"data"`
+
+	// If set, Data is sealed to the public key of each target Agent before being dispatched to it
+	Encrypted bool `json:"encrypted"`
+
 	Args   struct {
 		Name string `json:"name"`
 	} `json:"args"`
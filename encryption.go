@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/seal"
+)
+
+// Returns a copy of the command with its Data sealed to the public key registered by the given Agent
+func sealCommand(agentID core.AgentID, command *core.Command) (*core.Command, error) {
+	keyPEM, err := agentKeys.PublicKey(agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyPEM == nil {
+		return nil, fmt.Errorf("agent %d:%d has not registered a public key", agentID.GID, agentID.NID)
+	}
+
+	key, err := seal.ParsePublicKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := seal.Seal(key, []byte(command.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	sealedCommand := *command
+	sealedCommand.Data = sealed
+
+	return &sealedCommand, nil
+}
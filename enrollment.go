@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/enrollment"
+	"github.com/amrhassan/agentcontroller2/settings"
+)
+
+const defaultEnrollmentTokenTTL = 24 * time.Hour
+
+type enrollmentTokenRequest struct {
+	Gid *uint `json:"gid"`
+	Nid *uint `json:"nid"`
+	//TTL of the token in seconds
+	TTL int `json:"ttl"`
+}
+
+type enrollmentRequest struct {
+	ID string `json:"id"`
+}
+
+//internalEnrollmentToken issues a token for the agent given as {"gid": x, "nid": y, "ttl": seconds} in
+//the command data. Like an agent token it is a secret result, the client has to wait for it on the result queue.
+func internalEnrollmentToken(store *enrollment.Store) func(*core.Command) (interface{}, error) {
+	return func(cmd *core.Command) (interface{}, error) {
+		var request enrollmentTokenRequest
+		if err := json.Unmarshal([]byte(cmd.Data), &request); err != nil {
+			return nil, err
+		}
+
+		if request.Gid == nil || request.Nid == nil {
+			return nil, errors.New("both gid and nid are required")
+		}
+
+		ttl := defaultEnrollmentTokenTTL
+		if request.TTL > 0 {
+			ttl = time.Duration(request.TTL) * time.Second
+		}
+
+		token, err := store.IssueToken(*request.Gid, *request.Nid, ttl)
+		if err != nil {
+			return nil, err
+		}
+
+		return &secretResult{value: token}, nil
+	}
+}
+
+//installEnrollment loads the enrollment CA and registers the enrollment internal commands
+func installEnrollment(globalSettings *settings.Settings) error {
+	validity := time.Duration(globalSettings.Enrollment.ValidityDays) * 24 * time.Hour
+	if validity <= 0 {
+		validity = 365 * 24 * time.Hour
+	}
+
+	authority, err := enrollment.LoadAuthority(globalSettings.Enrollment.CACert, globalSettings.Enrollment.CAKey,
+		validity, globalSettings.ClientIdentity)
+	if err != nil {
+		return err
+	}
+
+	store := enrollment.NewStore(pool)
+
+	internals["enrollment_token"] = internalEnrollmentToken(store)
+
+	internals["enrollment_list"] = func(cmd *core.Command) (interface{}, error) {
+		return store.List()
+	}
+
+	internals["enrollment_approve"] = func(cmd *core.Command) (interface{}, error) {
+		var request enrollmentRequest
+		if err := json.Unmarshal([]byte(cmd.Data), &request); err != nil {
+			return nil, err
+		}
+
+		return store.Approve(request.ID, authority)
+	}
+
+	internals["enrollment_deny"] = func(cmd *core.Command) (interface{}, error) {
+		var request enrollmentRequest
+		if err := json.Unmarshal([]byte(cmd.Data), &request); err != nil {
+			return nil, err
+		}
+
+		return store.Deny(request.ID)
+	}
+
+	return nil
+}
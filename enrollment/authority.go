@@ -0,0 +1,121 @@
+// Enrollment of new Agents: a one-time token and a CSR are exchanged, after an operator's approval,
+// for a client certificate that encodes the Agent's gid/nid.
+package enrollment
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/settings"
+)
+
+// Authority signs Agent client certificates with the configured enrollment CA
+type Authority struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+	validity    time.Duration
+	identity    settings.ClientIdentity
+}
+
+// Loads the CA certificate and key from PEM files.
+// The identity decides how the gid/nid are encoded in the issued certificates.
+func LoadAuthority(certFile string, keyFile string, validity time.Duration, identity settings.ClientIdentity) (*Authority, error) {
+	if !identity.Enabled() {
+		return nil, errors.New("enrollment requires a clientidentity to encode the gid/nid in certificates")
+	}
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("enrollment CA key can't be used for signing")
+	}
+
+	return &Authority{
+		certificate: certificate,
+		key:         key,
+		validity:    validity,
+		identity:    identity,
+	}, nil
+}
+
+// Issues a PEM-encoded client certificate for the Agent with the public key of the CSR
+func (authority *Authority) Sign(csrPEM []byte, gid uint, nid uint) ([]byte, error) {
+	request, err := parseCertificateRequest(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	name := authority.identity.Name(gid, nid)
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(authority.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if authority.identity.Field == "SAN" {
+		template.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, authority.certificate, request.PublicKey, authority.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func parseCertificateRequest(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no PEM encoded certificate request found")
+	}
+
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := request.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %v", err)
+	}
+
+	return request, nil
+}
@@ -0,0 +1,87 @@
+package enrollment_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/enrollment"
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	assert.NoError(t, err)
+}
+
+func TestAuthoritySignsAgentIdentity(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "enrollment")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "agents"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	caKeyDER, err := x509.MarshalECPrivateKey(caKey)
+	assert.NoError(t, err)
+
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", caDER)
+	writePEM(t, filepath.Join(dir, "ca.key"), "EC PRIVATE KEY", caKeyDER)
+
+	identity := settings.ClientIdentity{Field: "SAN", Format: "%d-%d"}
+	authority, err := enrollment.LoadAuthority(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), 24*time.Hour, identity)
+	assert.NoError(t, err)
+
+	agentKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "whatever the agent asks for"},
+	}, agentKey)
+	assert.NoError(t, err)
+
+	certPEM, err := authority.Sign(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), 2, 7)
+	assert.NoError(t, err)
+
+	block, _ := pem.Decode(certPEM)
+	assert.NotNil(t, block)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "2-7", certificate.Subject.CommonName)
+	assert.Equal(t, []string{"2-7"}, certificate.DNSNames)
+
+	caCertificate, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(caCertificate)
+	_, err = certificate.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	assert.NoError(t, err)
+
+	_, err = authority.Sign([]byte("garbage"), 2, 7)
+	assert.Error(t, err)
+}
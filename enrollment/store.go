@@ -0,0 +1,239 @@
+package enrollment
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+const (
+	hashEnrollmentTokens   = "enrollment.tokens"
+	hashEnrollmentRequests = "enrollment.requests"
+	enrollmentTokenSize    = 32
+
+	StatePending  = "PENDING"
+	StateApproved = "APPROVED"
+	StateDenied   = "DENIED"
+)
+
+// Returned when an enrollment token is unknown, expired or already used
+var ErrInvalidToken = errors.New("invalid enrollment token")
+
+// Returned when an enrollment request doesn't exist
+var ErrNotFound = errors.New("enrollment not found")
+
+// An enrollment request submitted by an Agent
+type Enrollment struct {
+	ID          string `json:"id"`
+	Gid         uint   `json:"gid"`
+	Nid         uint   `json:"nid"`
+	State       string `json:"state"`
+	CSR         string `json:"csr"`
+	Certificate string `json:"certificate,omitempty"`
+	Created     int64  `json:"created"`
+}
+
+type enrollmentToken struct {
+	Gid     uint  `json:"gid"`
+	Nid     uint  `json:"nid"`
+	Expires int64 `json:"expires"`
+}
+
+// Store keeps enrollment tokens (hashed) and requests in Redis
+type Store struct {
+	pool *redis.Pool
+}
+
+func NewStore(pool *redis.Pool) *Store {
+	return &Store{pool: pool}
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Issues a one-time token that allows enrolling as the given Agent until it expires
+func (store *Store) IssueToken(gid uint, nid uint, ttl time.Duration) (string, error) {
+	raw := make([]byte, enrollmentTokenSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	data, err := json.Marshal(&enrollmentToken{Gid: gid, Nid: nid, Expires: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	db := store.pool.Get()
+	defer db.Close()
+
+	if _, err := db.Do("HSET", hashEnrollmentTokens, hashToken(token), data); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Consumes the token and records a pending enrollment for the CSR
+func (store *Store) Submit(token string, csrPEM []byte) (*Enrollment, error) {
+	if _, err := parseCertificateRequest(csrPEM); err != nil {
+		return nil, err
+	}
+
+	db := store.pool.Get()
+	defer db.Close()
+
+	key := hashToken(token)
+	data, err := redis.Bytes(db.Do("HGET", hashEnrollmentTokens, key))
+	if err == redis.ErrNil {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//whoever deletes the token first gets to use it
+	deleted, err := redis.Int(db.Do("HDEL", hashEnrollmentTokens, key))
+	if err != nil {
+		return nil, err
+	}
+	if deleted == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	var issued enrollmentToken
+	if err := json.Unmarshal(data, &issued); err != nil {
+		return nil, err
+	}
+
+	if time.Now().Unix() > issued.Expires {
+		return nil, ErrInvalidToken
+	}
+
+	enrollment := &Enrollment{
+		ID:      uuid.New(),
+		Gid:     issued.Gid,
+		Nid:     issued.Nid,
+		State:   StatePending,
+		CSR:     string(csrPEM),
+		Created: time.Now().Unix(),
+	}
+
+	if err := store.save(db, enrollment); err != nil {
+		return nil, err
+	}
+
+	return enrollment, nil
+}
+
+func (store *Store) Get(id string) (*Enrollment, error) {
+	db := store.pool.Get()
+	defer db.Close()
+
+	return store.get(db, id)
+}
+
+func (store *Store) List() ([]*Enrollment, error) {
+	db := store.pool.Get()
+	defer db.Close()
+
+	all, err := redis.StringMap(db.Do("HGETALL", hashEnrollmentRequests))
+	if err != nil {
+		return nil, err
+	}
+
+	enrollments := make([]*Enrollment, 0, len(all))
+	for id, data := range all {
+		enrollment := &Enrollment{}
+		if err := json.Unmarshal([]byte(data), enrollment); err != nil {
+			return nil, fmt.Errorf("malformed enrollment %s: %v", id, err)
+		}
+		enrollments = append(enrollments, enrollment)
+	}
+
+	return enrollments, nil
+}
+
+// Signs the CSR of a pending enrollment with the authority
+func (store *Store) Approve(id string, authority *Authority) (*Enrollment, error) {
+	db := store.pool.Get()
+	defer db.Close()
+
+	enrollment, err := store.pending(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := authority.Sign([]byte(enrollment.CSR), enrollment.Gid, enrollment.Nid)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollment.State = StateApproved
+	enrollment.Certificate = string(certificate)
+
+	return enrollment, store.save(db, enrollment)
+}
+
+func (store *Store) Deny(id string) (*Enrollment, error) {
+	db := store.pool.Get()
+	defer db.Close()
+
+	enrollment, err := store.pending(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollment.State = StateDenied
+
+	return enrollment, store.save(db, enrollment)
+}
+
+func (store *Store) pending(db redis.Conn, id string) (*Enrollment, error) {
+	enrollment, err := store.get(db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if enrollment.State != StatePending {
+		return nil, fmt.Errorf("enrollment %s is %s, not %s", id, enrollment.State, StatePending)
+	}
+
+	return enrollment, nil
+}
+
+func (store *Store) get(db redis.Conn, id string) (*Enrollment, error) {
+	data, err := redis.Bytes(db.Do("HGET", hashEnrollmentRequests, id))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	enrollment := &Enrollment{}
+	if err := json.Unmarshal(data, enrollment); err != nil {
+		return nil, err
+	}
+
+	return enrollment, nil
+}
+
+func (store *Store) save(db redis.Conn, enrollment *Enrollment) error {
+	data, err := json.Marshal(enrollment)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Do("HSET", hashEnrollmentRequests, enrollment.ID, data)
+	return err
+}
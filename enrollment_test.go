@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/enrollment"
+	"github.com/amrhassan/agentcontroller2/redisdata"
+	"github.com/amrhassan/agentcontroller2/retention"
+	"github.com/stretchr/testify/assert"
+)
+
+func certificateRequest(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "agent"},
+	}, key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func TestIssuedEnrollmentTokenIsNotKept(t *testing.T) {
+
+	fake := newFakeRedis()
+	pool := fake.pool()
+	redisData = redisdata.NewRedisData(pool)
+	keeper = retention.NewKeeper(pool, retention.Options{})
+	store := enrollment.NewStore(pool)
+	internals["enrollment_token"] = internalEnrollmentToken(store)
+	defer delete(internals, "enrollment_token")
+
+	command := &core.Command{ID: "job", Gid: 1, Nid: 2, Cmd: cmdInternal, Data: `{"gid": 3, "nid": 4}`}
+	command.Args.Name = "enrollment_token"
+	processInternalCommand(command)
+
+	queue := fake.lists["cmd.job.1.2"]
+	if assert.Len(t, queue, 1) {
+		delivered := &core.CommandResult{}
+		assert.NoError(t, json.Unmarshal([]byte(queue[0]), delivered))
+		var token string
+		assert.NoError(t, json.Unmarshal([]byte(delivered.Data), &token))
+		assert.NotContains(t, fake.hashes["jobresult:job"]["1:2"], token)
+
+		enrolled, err := store.Submit(token, certificateRequest(t))
+		assert.NoError(t, err)
+		assert.Equal(t, uint(3), enrolled.Gid)
+		assert.Equal(t, uint(4), enrolled.Nid)
+		assert.Equal(t, enrollment.StatePending, enrolled.State)
+	}
+}
+
+func TestEnrollmentTokenIsUsedOnce(t *testing.T) {
+
+	store := enrollment.NewStore(newFakeRedis().pool())
+	csr := certificateRequest(t)
+
+	token, err := store.IssueToken(3, 4, time.Hour)
+	assert.NoError(t, err)
+
+	_, err = store.Submit(token, csr)
+	assert.NoError(t, err)
+	_, err = store.Submit(token, csr)
+	assert.Equal(t, enrollment.ErrInvalidToken, err)
+
+	expired, err := store.IssueToken(3, 4, -time.Minute)
+	assert.NoError(t, err)
+	_, err = store.Submit(expired, csr)
+	assert.Equal(t, enrollment.ErrInvalidToken, err)
+
+	//the expired token is gone as well
+	_, err = store.Submit(expired, csr)
+	assert.Equal(t, enrollment.ErrInvalidToken, err)
+
+	_, err = store.Submit("unknown", csr)
+	assert.Equal(t, enrollment.ErrInvalidToken, err)
+
+	enrollments, err := store.List()
+	assert.NoError(t, err)
+	assert.Len(t, enrollments, 1)
+}
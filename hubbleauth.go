@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	hubbleAuth "github.com/Jumpscale/hubble/auth"
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/settings"
+)
+
+const (
+	hubbleAuditLog     = "hubble.audit"
+	hubbleAuditLogSize = 1000
+)
+
+/*
+hubbleAuthModule authorizes hubble tunnels against the allow-list in the settings.
+
+Agents identify themselves with their hubble key, formatted as "gid:nid:token" where token is the
+agent token when agent tokens are enabled. Otherwise the key is "gid:nid:session", only accepted
+while the hubble connection that announced the session is open and its verified client certificate
+belongs to that agent. Without tokens or client certificates no tunnel is allowed, the key alone
+proves nothing.
+*/
+type hubbleAuthModule struct {
+	rules      []settings.HubbleRule
+	tokens     core.AgentTokenStorage
+	identities hubbleIdentities
+}
+
+//hubbleIdentities tells which agent proved who it is with a client certificate on the hubble
+//connection that announced a session
+type hubbleIdentities interface {
+	Identity(session string) (core.AgentID, bool)
+}
+
+type hubbleAuditEntry struct {
+	Time    int64  `json:"time"`
+	Key     string `json:"agent"`
+	Gateway string `json:"gateway"`
+	IP      string `json:"ip"`
+	Port    uint16 `json:"port"`
+	Reason  string `json:"reason"`
+}
+
+//newHubbleAuthModule creates the hubble auth module, tokens should be nil if agent tokens are disabled
+//and identities nil if client identities aren't checked
+func newHubbleAuthModule(rules []settings.HubbleRule, tokens core.AgentTokenStorage, identities hubbleIdentities) *hubbleAuthModule {
+	return &hubbleAuthModule{
+		rules:      rules,
+		tokens:     tokens,
+		identities: identities,
+	}
+}
+
+func (module *hubbleAuthModule) Connect(request *hubbleAuth.ConnectionRequest) error {
+	agentID, err := module.authenticate(request.Key)
+	if err != nil {
+		module.audit(request, err.Error())
+		return err
+	}
+
+	for _, rule := range module.rules {
+		if hubbleRuleAllows(rule, agentID, request) {
+			return nil
+		}
+	}
+
+	err = fmt.Errorf("tunnel to %s:%d through %s is not allowed", request.IP, request.Port, request.Gateway)
+	module.audit(request, err.Error())
+	return err
+}
+
+func (module *hubbleAuthModule) authenticate(key string) (core.AgentID, error) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) < 2 {
+		return core.AgentID{}, errors.New("hubble key does not identify an agent")
+	}
+
+	gid, err := strconv.ParseUint(parts[0], 10, 0)
+	if err != nil {
+		return core.AgentID{}, errors.New("hubble key has an invalid gid")
+	}
+
+	nid, err := strconv.ParseUint(parts[1], 10, 0)
+	if err != nil {
+		return core.AgentID{}, errors.New("hubble key has an invalid nid")
+	}
+
+	agentID := core.AgentID{GID: uint(gid), NID: uint(nid)}
+
+	if module.tokens == nil {
+		if module.identities == nil {
+			return core.AgentID{}, errors.New("hubble tunnels need agent tokens or client certificates")
+		}
+		if len(parts) != 3 {
+			return core.AgentID{}, errors.New("hubble key is missing the session")
+		}
+		verified, ok := module.identities.Identity(parts[2])
+		if !ok {
+			return core.AgentID{}, errors.New("hubble key has a session no verified hubble connection announced")
+		}
+		if verified != agentID {
+			return core.AgentID{}, fmt.Errorf("hubble key names agent %d:%d, its session belongs to %d:%d",
+				gid, nid, verified.GID, verified.NID)
+		}
+		return agentID, nil
+	}
+
+	if len(parts) != 3 {
+		return core.AgentID{}, errors.New("hubble key is missing the agent token")
+	}
+
+	valid, err := module.tokens.VerifyToken(agentID, parts[2])
+	if err != nil {
+		return core.AgentID{}, err
+	}
+
+	if !valid {
+		return core.AgentID{}, errors.New("hubble key has an invalid agent token")
+	}
+
+	return agentID, nil
+}
+
+//audit records a denied tunnel in the log and in a capped redis list
+func (module *hubbleAuthModule) audit(request *hubbleAuth.ConnectionRequest, reason string) {
+	//never keep the token or session part of the key around
+	agent := request.Key
+	if parts := strings.SplitN(agent, ":", 3); len(parts) == 3 {
+		agent = parts[0] + ":" + parts[1]
+	}
+
+	log.Printf("[audit] hubble: denied tunnel for agent %q to %s:%d through %q: %s\n",
+		agent, request.IP, request.Port, request.Gateway, reason)
+
+	entry, err := json.Marshal(&hubbleAuditEntry{
+		Time:    time.Now().Unix(),
+		Key:     agent,
+		Gateway: request.Gateway,
+		IP:      request.IP,
+		Port:    request.Port,
+		Reason:  reason,
+	})
+	if err != nil {
+		log.Println("[-] failed to serialize hubble audit entry", err)
+		return
+	}
+
+	db := pool.Get()
+	defer db.Close()
+
+	db.Send("MULTI")
+	db.Send("LPUSH", hubbleAuditLog, entry)
+	db.Send("LTRIM", hubbleAuditLog, 0, hubbleAuditLogSize-1)
+	if _, err := db.Do("EXEC"); err != nil {
+		log.Println("[-] failed to push hubble audit entry", err)
+	}
+}
+
+func hubbleRuleAllows(rule settings.HubbleRule, agentID core.AgentID, request *hubbleAuth.ConnectionRequest) bool {
+	matches := func(pattern string, values ...string) bool {
+		if pattern == "" || pattern == "*" {
+			return true
+		}
+		for _, value := range values {
+			if pattern == value {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !matches(rule.Agent, fmt.Sprintf("%d:%d", agentID.GID, agentID.NID), fmt.Sprintf("%d:*", agentID.GID)) {
+		return false
+	}
+
+	if !matches(rule.Gateway, request.Gateway) || !matches(rule.Host, request.IP) {
+		return false
+	}
+
+	if len(rule.Ports) == 0 {
+		return true
+	}
+
+	for _, port := range rule.Ports {
+		if port == int(request.Port) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	hubbleAuth "github.com/Jumpscale/hubble/auth"
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/redisdata"
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeHubbleIdentities map[string]core.AgentID
+
+func (identities fakeHubbleIdentities) Identity(session string) (core.AgentID, bool) {
+	id, ok := identities[session]
+	return id, ok
+}
+
+func TestHubbleRuleAllows(t *testing.T) {
+
+	agent := core.AgentID{GID: 1, NID: 2}
+	request := &hubbleAuth.ConnectionRequest{Gateway: "controller", IP: "127.0.0.1", Port: 22000}
+
+	assert.True(t, hubbleRuleAllows(settings.HubbleRule{}, agent, request))
+	assert.True(t, hubbleRuleAllows(settings.HubbleRule{Agent: "1:2", Gateway: "controller", Host: "127.0.0.1", Ports: []int{22, 22000}}, agent, request))
+	assert.True(t, hubbleRuleAllows(settings.HubbleRule{Agent: "1:*"}, agent, request))
+
+	assert.False(t, hubbleRuleAllows(settings.HubbleRule{Agent: "1:3"}, agent, request))
+	assert.False(t, hubbleRuleAllows(settings.HubbleRule{Agent: "2:*"}, agent, request))
+	assert.False(t, hubbleRuleAllows(settings.HubbleRule{Gateway: "other"}, agent, request))
+	assert.False(t, hubbleRuleAllows(settings.HubbleRule{Host: "10.0.0.1"}, agent, request))
+	assert.False(t, hubbleRuleAllows(settings.HubbleRule{Ports: []int{22}}, agent, request))
+}
+
+func TestHubbleAuthenticateWithTokens(t *testing.T) {
+
+	tokens := redisdata.NewRedisData(newFakeRedis().pool())
+	agent := core.AgentID{GID: 1, NID: 2}
+	token, err := tokens.IssueToken(agent)
+	assert.NoError(t, err)
+
+	module := newHubbleAuthModule(nil, tokens, nil)
+
+	id, err := module.authenticate("1:2:" + token)
+	assert.NoError(t, err)
+	assert.Equal(t, agent, id)
+
+	_, err = module.authenticate("1:2")
+	assert.Error(t, err)
+	_, err = module.authenticate("1:2:wrong")
+	assert.Error(t, err)
+	_, err = module.authenticate("1:3:" + token)
+	assert.Error(t, err)
+	_, err = module.authenticate("x:2:" + token)
+	assert.Error(t, err)
+}
+
+func TestHubbleAuthenticateWithClientIdentity(t *testing.T) {
+
+	module := newHubbleAuthModule(nil, nil, fakeHubbleIdentities{
+		"session of 1:2": {GID: 1, NID: 2},
+		"session of 1:3": {GID: 1, NID: 3},
+	})
+
+	id, err := module.authenticate("1:2:session of 1:2")
+	assert.NoError(t, err)
+	assert.Equal(t, core.AgentID{GID: 1, NID: 2}, id)
+
+	//an agent can't borrow the identity of another one, even while that one is connected
+	_, err = module.authenticate("1:2:session of 1:3")
+	assert.Error(t, err)
+	_, err = module.authenticate("1:2:unknown session")
+	assert.Error(t, err)
+	_, err = module.authenticate("1:2")
+	assert.Error(t, err)
+	_, err = module.authenticate("1")
+	assert.Error(t, err)
+}
+
+func TestHubbleAuthenticateWithoutCredentials(t *testing.T) {
+
+	module := newHubbleAuthModule(nil, nil, nil)
+
+	_, err := module.authenticate("1:2")
+	assert.Error(t, err)
+	_, err = module.authenticate("1:2:token")
+	assert.Error(t, err)
+}
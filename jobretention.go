@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+)
+
+type purgeJobsRequest struct {
+	OlderThan int `json:"older_than"`
+}
+
+// Deletes the jobs that finished more than {"older_than": seconds} ago, all the finished ones by default
+func internalPurgeJobs(cmd *core.Command) (interface{}, error) {
+	var request purgeJobsRequest
+	if cmd.Data != "" {
+		if err := json.Unmarshal([]byte(cmd.Data), &request); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.OlderThan < 0 {
+		return nil, errors.New("older_than can't be negative")
+	}
+
+	purged, err := keeper.Purge(time.Now().Add(-time.Duration(request.OlderThan) * time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]int{"purged": purged}, nil
+}
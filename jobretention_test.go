@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/retention"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveRequeuesClaimedJobsOnFailure(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fake := newFakeRedis()
+	finished := time.Now().Add(-time.Hour).Unix()
+	for _, id := range []string{"first", "second"} {
+		storeResult(t, fake, id, 1, 2, "SUCCESS")
+		fake.zset("jobs.archive")[id] = float64(finished)
+	}
+	queued := map[string]float64{"first": float64(finished), "second": float64(finished)}
+
+	//the archive can't be written where a file is in the way
+	blocked := filepath.Join(dir, "blocked")
+	assert.NoError(t, ioutil.WriteFile(blocked, nil, 0644))
+	archived, err := retention.NewKeeper(fake.pool(), retention.Options{TTL: time.Hour, ArchiveDir: blocked}).Archive(time.Now())
+	assert.Error(t, err)
+	assert.Equal(t, 0, archived)
+	assert.Equal(t, queued, fake.zsets["jobs.archive"])
+
+	//nor can the logs of the jobs be read
+	keeper := retention.NewKeeper(fake.pool(), retention.Options{TTL: time.Hour, ArchiveDir: dir})
+	fake.failures["LRANGE"] = errors.New("connection lost")
+	archived, err = keeper.Archive(time.Now())
+	assert.Error(t, err)
+	assert.Equal(t, 0, archived)
+	assert.Equal(t, queued, fake.zsets["jobs.archive"])
+
+	delete(fake.failures, "LRANGE")
+	archived, err = keeper.Archive(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, archived)
+	assert.Empty(t, fake.zsets["jobs.archive"])
+	assert.Contains(t, fake.ttls, "jobresult:first")
+}
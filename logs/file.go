@@ -0,0 +1,125 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	DefaultFileMaxSize    = 100 * 1024 * 1024
+	DefaultFileMaxBackups = 5
+)
+
+/*
+Appends the entries to a file, one JSON object per line. Once the file grows past MaxSize bytes it
+is renamed to path.1, the previous path.1 to path.2 and so on, keeping at most MaxBackups of them.
+When that fails, the entries keep going to the file past its size until rotating works again.
+*/
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Opens the file at path for appending, non positive sizes fall back to the defaults
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultFileMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = DefaultFileMaxBackups
+	}
+
+	sink := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *FileSink) open() error {
+	file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = info.Size()
+	return nil
+}
+
+func (sink *FileSink) Write(entries []*Entry) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+
+		if sink.size > 0 && sink.size+int64(len(line)) > sink.maxSize {
+			if err := sink.rotate(); err != nil {
+				log.Println("Logs: failed to rotate", sink.path, err)
+			}
+		}
+
+		//the file couldn't be opened again after a rotation
+		if sink.file == nil {
+			if err := sink.open(); err != nil {
+				return err
+			}
+		}
+
+		written, err := sink.file.Write(line)
+		sink.size += int64(written)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Shifts the backups and starts a new file, must be called with the lock held. If the file can't be
+renamed it is opened again as it is, the file is nil only if that fails too.
+*/
+func (sink *FileSink) rotate() error {
+	sink.file.Close()
+	sink.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", sink.path, sink.maxBackups))
+	for i := sink.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", sink.path, i), fmt.Sprintf("%s.%d", sink.path, i+1))
+	}
+	if err := os.Rename(sink.path, sink.path+".1"); err != nil {
+		if reopenErr := sink.open(); reopenErr != nil {
+			return reopenErr
+		}
+		return err
+	}
+
+	return sink.open()
+}
+
+func (sink *FileSink) Close() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	return sink.file.Close()
+}
@@ -0,0 +1,131 @@
+// Structured job logs posted by the agents
+package logs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A single log message of a job, as run by an agent
+type Entry struct {
+	JobID string `json:"id"`
+	Gid   uint   `json:"gid"`
+	Nid   uint   `json:"nid"`
+	Cmd   string `json:"cmd,omitempty"`
+	Level int    `json:"level"`
+	// Epoch is the unix time of the message in milliseconds
+	Epoch   int64  `json:"epoch"`
+	Message string `json:"message"`
+}
+
+func (entry *Entry) Time() time.Time {
+	return time.Unix(0, entry.Epoch*int64(time.Millisecond))
+}
+
+// A message as posted by the agents, its text is in data
+type message struct {
+	ID      interface{} `json:"id"`
+	Cmd     string      `json:"cmd"`
+	Level   int         `json:"level"`
+	Epoch   int64       `json:"epoch"`
+	Data    string      `json:"data"`
+	Message string      `json:"message"`
+}
+
+/*
+Parses the body an agent posts to /:gid/:nid/log, either a single message or an array of them.
+Messages are attributed to the posting agent, those without an epoch are at now.
+*/
+func Parse(content []byte, gid uint, nid uint, now time.Time) ([]*Entry, error) {
+	content = []byte(strings.TrimSpace(string(content)))
+	if len(content) == 0 {
+		return nil, errors.New("empty log")
+	}
+
+	var messages []message
+	if content[0] == '[' {
+		if err := json.Unmarshal(content, &messages); err != nil {
+			return nil, err
+		}
+	} else {
+		var single message
+		if err := json.Unmarshal(content, &single); err != nil {
+			return nil, err
+		}
+		messages = append(messages, single)
+	}
+
+	entries := make([]*Entry, 0, len(messages))
+	for _, message := range messages {
+		entry := &Entry{
+			Gid:     gid,
+			Nid:     nid,
+			Cmd:     message.Cmd,
+			Level:   message.Level,
+			Epoch:   message.Epoch,
+			Message: message.Message,
+		}
+
+		switch id := message.ID.(type) {
+		case string:
+			entry.JobID = id
+		case float64:
+			entry.JobID = fmt.Sprint(int64(id))
+		}
+
+		if entry.Message == "" {
+			entry.Message = message.Data
+		}
+		if entry.Epoch == 0 {
+			entry.Epoch = now.UnixNano() / int64(time.Millisecond)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Selects log entries, zero values match everything
+type Filter struct {
+	Levels []int
+	Since  time.Time
+	Until  time.Time
+	Gid    *uint
+	Nid    *uint
+}
+
+func (filter *Filter) Match(entry *Entry) bool {
+	if len(filter.Levels) > 0 {
+		found := false
+		for _, level := range filter.Levels {
+			if level == entry.Level {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	at := entry.Time()
+	if !filter.Since.IsZero() && at.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && at.After(filter.Until) {
+		return false
+	}
+
+	if filter.Gid != nil && *filter.Gid != entry.Gid {
+		return false
+	}
+	if filter.Nid != nil && *filter.Nid != entry.Nid {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,46 @@
+package logs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/logs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+
+	now := time.Unix(1445000000, 0)
+
+	entries, err := logs.Parse([]byte(`[
+		{"id": "job-1", "cmd": "execute", "level": 1, "epoch": 1444999999500, "data": "hello"},
+		{"id": 42, "level": 2, "message": "oops"}
+	]`), 3, 7, now)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []*logs.Entry{
+		{JobID: "job-1", Gid: 3, Nid: 7, Cmd: "execute", Level: 1, Epoch: 1444999999500, Message: "hello"},
+		{JobID: "42", Gid: 3, Nid: 7, Level: 2, Epoch: 1445000000000, Message: "oops"},
+	}, entries)
+
+	single, err := logs.Parse([]byte(`{"id": "job-2", "level": 3, "data": "alone"}`), 1, 1, now)
+	assert.NoError(t, err)
+	assert.Len(t, single, 1)
+
+	_, err = logs.Parse([]byte(`not json`), 1, 1, now)
+	assert.Error(t, err)
+}
+
+func TestFilter(t *testing.T) {
+
+	entry := &logs.Entry{Gid: 1, Nid: 2, Level: 2, Epoch: 1445000000000}
+	gid, otherGid := uint(1), uint(5)
+
+	assert.True(t, (&logs.Filter{}).Match(entry))
+	assert.True(t, (&logs.Filter{Levels: []int{1, 2}, Gid: &gid}).Match(entry))
+	assert.False(t, (&logs.Filter{Levels: []int{1}}).Match(entry))
+	assert.False(t, (&logs.Filter{Gid: &otherGid}).Match(entry))
+	assert.True(t, (&logs.Filter{Since: time.Unix(1445000000, 0), Until: time.Unix(1445000000, 0)}).Match(entry))
+	assert.False(t, (&logs.Filter{Since: time.Unix(1445000001, 0)}).Match(entry))
+	assert.False(t, (&logs.Filter{Until: time.Unix(1444999999, 0)}).Match(entry))
+}
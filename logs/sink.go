@@ -0,0 +1,98 @@
+package logs
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	SinkFile    = "file"
+	SinkSyslog  = "syslog"
+	SinkWebhook = "webhook"
+
+	// Batches waiting for a slow sink before new ones are dropped
+	sinkQueueSize = 1000
+)
+
+// Sinks forward the log entries agents post, next to the ones kept in redis
+type Sink interface {
+	Write(entries []*Entry) error
+}
+
+// Returned when the sink type in the settings is unknown
+func UnknownSinkError(name string) error {
+	return fmt.Errorf("unknown log sink %q, expected %s, %s or %s", name, SinkFile, SinkSyslog, SinkWebhook)
+}
+
+// Forwards only the entries of the given levels to a sink, all of them if there are none
+type LevelSink struct {
+	Sink   Sink
+	Levels []int
+}
+
+func (filtered *LevelSink) Write(entries []*Entry) error {
+	if len(filtered.Levels) == 0 {
+		return filtered.Sink.Write(entries)
+	}
+
+	filter := Filter{Levels: filtered.Levels}
+	matching := make([]*Entry, 0, len(entries))
+	for _, entry := range entries {
+		if filter.Match(entry) {
+			matching = append(matching, entry)
+		}
+	}
+
+	if len(matching) == 0 {
+		return nil
+	}
+	return filtered.Sink.Write(matching)
+}
+
+type queuedSink struct {
+	name    string
+	sink    Sink
+	batches chan []*Entry
+}
+
+func (queued *queuedSink) run() {
+	for batch := range queued.batches {
+		if err := queued.sink.Write(batch); err != nil {
+			log.Println("Logs: failed to forward", len(batch), "entries to", queued.name, "sink:", err)
+		}
+	}
+}
+
+/*
+Forwards the entries to several sinks in the background, so that a slow or unavailable sink doesn't
+hold the agents posting logs. Each sink has its own queue, batches are dropped when it is full.
+*/
+type Fanout struct {
+	sinks []*queuedSink
+}
+
+// Starts forwarding to the sinks, the names are only used in the logs
+func NewFanout(names []string, sinks []Sink) *Fanout {
+	fanout := &Fanout{}
+	for i, sink := range sinks {
+		queued := &queuedSink{
+			name:    names[i],
+			sink:    sink,
+			batches: make(chan []*Entry, sinkQueueSize),
+		}
+		go queued.run()
+		fanout.sinks = append(fanout.sinks, queued)
+	}
+	return fanout
+}
+
+func (fanout *Fanout) Write(entries []*Entry) error {
+	for _, queued := range fanout.sinks {
+		select {
+		case queued.batches <- entries:
+		default:
+			log.Println("Logs: dropped", len(entries), "entries, the", queued.name, "sink is falling behind")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package logs_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/logs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSink(t *testing.T) {
+
+	var received []*logs.Entry
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	sink := logs.NewWebhookSink(server.URL, map[string]string{"Authorization": "Bearer secret"}, 0)
+	leveled := &logs.LevelSink{Sink: sink, Levels: []int{2}}
+
+	entries := []*logs.Entry{
+		{JobID: "job-1", Gid: 1, Nid: 2, Level: 1, Epoch: 1445000000000, Message: "out"},
+		{JobID: "job-1", Gid: 1, Nid: 2, Level: 2, Epoch: 1445000000000, Message: "err"},
+	}
+	assert.NoError(t, leveled.Write(entries))
+
+	assert.Equal(t, "Bearer secret", authorization)
+	assert.Equal(t, []*logs.Entry{entries[1]}, received)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	assert.Error(t, logs.NewWebhookSink(failing.URL, nil, 0).Write(entries))
+}
+
+func TestFileSinkRotates(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "logs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jobs.log")
+	sink, err := logs.NewFileSink(path, 150, 2)
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, sink.Write([]*logs.Entry{{JobID: "job", Level: 1, Epoch: 1445000000000, Message: "hello"}}))
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		content, err := ioutil.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, strings.Count(string(content), "\n"), name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileSinkKeepsWritingWhenRotationFails(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "logs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	//a directory that isn't empty can't be removed nor replaced by the backup
+	path := filepath.Join(dir, "jobs.log")
+	assert.NoError(t, os.MkdirAll(filepath.Join(path+".1", "taken"), 0755))
+
+	sink, err := logs.NewFileSink(path, 150, 1)
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, sink.Write([]*logs.Entry{{JobID: "job", Level: 1, Epoch: 1445000000000, Message: "hello"}}))
+	}
+
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(content), "\n"))
+
+	//once the backup path is free again, rotating works
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	assert.NoError(t, sink.Write([]*logs.Entry{{JobID: "job", Level: 1, Epoch: 1445000000000, Message: "hello"}}))
+	content, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(content), "\n"))
+}
+
+func TestSyslogFormat(t *testing.T) {
+
+	sink, err := logs.NewSyslogSink("udp", "localhost:514", "")
+	assert.NoError(t, err)
+
+	message := sink.Format(&logs.Entry{JobID: `a"b`, Gid: 1, Nid: 2, Cmd: "execute", Level: 2, Epoch: 1445000000123, Message: "failed"})
+
+	assert.True(t, strings.HasPrefix(message, "<11>1 2015-10-16T12:53:20.123Z "), message)
+	assert.Contains(t, message, ` agentcontroller `)
+	assert.True(t, strings.HasSuffix(message, ` execute [job@32473 id="a\"b" gid="1" nid="2" level="2" cmd="execute"] failed`), message)
+
+	//the MSGID is at most 32 printable characters without spaces, the command is kept whole in the data
+	message = sink.Format(&logs.Entry{JobID: "job", Cmd: "a very long command name, longer than a msgid", Message: "done"})
+	assert.Contains(t, message, ` averylongcommandname,longerthana [job@32473 id="job" gid="0" nid="0" level="0" cmd="a very long command name, longer than a msgid"] done`)
+
+	message = sink.Format(&logs.Entry{JobID: "job", Message: "done"})
+	assert.Contains(t, message, ` - [job@32473 id="job" gid="0" nid="0" level="0"] done`)
+
+	_, err = logs.NewSyslogSink("pigeon", "", "")
+	assert.Error(t, err)
+}
+
+func TestSyslogStreamEscapesNewlines(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		var lines []string
+		for len(lines) < 2 {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+		received <- lines
+	}()
+
+	sink, err := logs.NewSyslogSink("tcp", listener.Addr().String(), "")
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write([]*logs.Entry{
+		{JobID: "job", Message: "first\nsecond"},
+		{JobID: "job", Message: "third"},
+	}))
+
+	lines := <-received
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasSuffix(lines[0], `] first\nsecond`), lines[0])
+		assert.True(t, strings.HasSuffix(lines[1], `] third`), lines[1])
+	}
+}
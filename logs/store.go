@@ -0,0 +1,226 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	listJobLogs   = "joblogs:%s"
+	listAgentLogs = "%d:%d:log"
+	// Carries every entry pushed for a job, and empty messages when its results change
+	channelJobLogs = "joblogs.%s"
+
+	// Subscriptions are pinged well within the read timeout of the pool connections
+	followKeepAlive = 5 * time.Second
+
+	DefaultJobSize   = 10000
+	DefaultAgentSize = 10000
+	DefaultRetention = 7 * 24 * time.Hour
+)
+
+// How many log entries are kept per job and per agent, and for how long after the last one
+type StoreOptions struct {
+	JobSize   int
+	AgentSize int
+	Retention time.Duration
+}
+
+// Keeps the latest log entries of every job and of every agent in capped redis lists
+type Store struct {
+	pool    *redis.Pool
+	options StoreOptions
+}
+
+func NewStore(pool *redis.Pool, options StoreOptions) *Store {
+	if options.JobSize <= 0 {
+		options.JobSize = DefaultJobSize
+	}
+	if options.AgentSize <= 0 {
+		options.AgentSize = DefaultAgentSize
+	}
+	if options.Retention <= 0 {
+		options.Retention = DefaultRetention
+	}
+
+	return &Store{pool: pool, options: options}
+}
+
+func (store *Store) Push(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	db := store.pool.Get()
+	defer db.Close()
+
+	retention := int64(store.options.Retention / time.Second)
+	touched := make(map[string]int)
+
+	db.Send("MULTI")
+	for _, entry := range entries {
+		dump, err := json.Marshal(entry)
+		if err != nil {
+			db.Do("DISCARD")
+			return err
+		}
+
+		agentKey := fmt.Sprintf(listAgentLogs, entry.Gid, entry.Nid)
+		db.Send("RPUSH", agentKey, dump)
+		touched[agentKey] = store.options.AgentSize
+
+		if entry.JobID != "" {
+			jobKey := fmt.Sprintf(listJobLogs, entry.JobID)
+			db.Send("RPUSH", jobKey, dump)
+			db.Send("PUBLISH", fmt.Sprintf(channelJobLogs, entry.JobID), dump)
+			touched[jobKey] = store.options.JobSize
+		}
+	}
+	for key, size := range touched {
+		db.Send("LTRIM", key, -size, -1)
+		db.Send("EXPIRE", key, retention)
+	}
+	_, err := db.Do("EXEC")
+
+	return err
+}
+
+// Returns the log entries of a job matching the filter, oldest first
+func (store *Store) Job(id string, filter *Filter) ([]*Entry, error) {
+	dumps, err := store.dumps(id)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*Entry, 0, len(dumps))
+	for _, dump := range dumps {
+		entry := &Entry{}
+		if err := json.Unmarshal([]byte(dump), entry); err != nil {
+			continue
+		}
+		if filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// Wakes up the followers of a job so they check whether it is finished
+func (store *Store) Signal(id string) error {
+	db := store.pool.Get()
+	defer db.Close()
+
+	_, err := db.Do("PUBLISH", fmt.Sprintf(channelJobLogs, id), "")
+	return err
+}
+
+/*
+Passes the entries of a job matching the filter to send, those already stored first, then the
+ones pushed while following. Following stops, without error, when stop fires or when finished
+returns true. Finished is called once the stored entries are sent, on every signal of the job
+and every few seconds.
+*/
+func (store *Store) Follow(id string, filter *Filter, stop <-chan bool, finished func() bool, send func(*Entry) error) error {
+	db := store.pool.Get()
+	defer db.Close()
+
+	pushed := redis.PubSubConn{Conn: db}
+	if err := pushed.Subscribe(fmt.Sprintf(channelJobLogs, id)); err != nil {
+		return err
+	}
+
+	stored, err := store.dumps(id)
+	if err != nil {
+		return err
+	}
+
+	//entries pushed right before subscribing are both stored and published, skip them once
+	seen := make(map[string]bool, len(stored))
+	for _, dump := range stored {
+		seen[dump] = true
+		if err := sendDump(dump, filter, send); err != nil {
+			return err
+		}
+	}
+
+	if finished() {
+		return nil
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(followKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pushed.Ping("")
+			case <-stop:
+				pushed.Unsubscribe()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		switch message := pushed.Receive().(type) {
+		case redis.Message:
+			dump := string(message.Data)
+			if dump == "" {
+				if finished() {
+					return nil
+				}
+				continue
+			}
+
+			if seen != nil {
+				if seen[dump] {
+					delete(seen, dump)
+					continue
+				}
+				seen = nil
+			}
+
+			if err := sendDump(dump, filter, send); err != nil {
+				return err
+			}
+		case redis.Pong:
+			if finished() {
+				return nil
+			}
+		case redis.Subscription:
+			if message.Count == 0 {
+				return nil
+			}
+		case error:
+			return message
+		}
+	}
+}
+
+func (store *Store) dumps(id string) ([]string, error) {
+	db := store.pool.Get()
+	defer db.Close()
+
+	return redis.Strings(db.Do("LRANGE", fmt.Sprintf(listJobLogs, id), 0, -1))
+}
+
+func sendDump(dump string, filter *Filter, send func(*Entry) error) error {
+	entry := &Entry{}
+	if err := json.Unmarshal([]byte(dump), entry); err != nil {
+		log.Println("Logs: skipping malformed entry", err)
+		return nil
+	}
+	if !filter.Match(entry) {
+		return nil
+	}
+	return send(entry)
+}
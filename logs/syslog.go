@@ -0,0 +1,159 @@
+package logs
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The user-level facility
+	syslogFacility = 1
+
+	syslogCritical = 2
+	syslogError    = 3
+	syslogWarning  = 4
+	syslogInfo     = 6
+	syslogDebug    = 7
+
+	// The private enterprise number the structured data of the entries is declared under
+	syslogEnterprise = 32473
+
+	DefaultSyslogTag = "agentcontroller"
+)
+
+var (
+	syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	// Over stream sockets an entry is a line, the newlines of its message are escaped
+	syslogLineEscaper = strings.NewReplacer("\n", `\n`, "\r", `\r`)
+)
+
+// Header fields are at most size printable US-ASCII characters without spaces, "-" if empty
+func syslogHeaderField(value string, size int) string {
+	field := make([]byte, 0, size)
+	for i := 0; i < len(value) && len(field) < size; i++ {
+		if value[i] >= 33 && value[i] <= 126 {
+			field = append(field, value[i])
+		}
+	}
+	if len(field) == 0 {
+		return "-"
+	}
+	return string(field)
+}
+
+// Maps the agent log levels to syslog severities
+func syslogSeverity(level int) int {
+	switch level {
+	case 2, 5:
+		return syslogError
+	case 4:
+		return syslogWarning
+	case 6:
+		return syslogCritical
+	case 8:
+		return syslogDebug
+	default:
+		return syslogInfo
+	}
+}
+
+/*
+Sends the entries to a syslog daemon in the RFC 5424 format, one datagram or, over stream sockets,
+one line per entry with its newlines escaped as \n. The job, agent, command and level of an entry are in its structured data, the
+command is also the MSGID.
+*/
+type SyslogSink struct {
+	network  string
+	address  string
+	tag      string
+	hostname string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// Network is unixgram, unix, udp or tcp, like /dev/log over unixgram or localhost:514 over udp
+func NewSyslogSink(network string, address string, tag string) (*SyslogSink, error) {
+	switch network {
+	case "unixgram", "unix", "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q, expected unixgram, unix, udp or tcp", network)
+	}
+	if tag == "" {
+		tag = DefaultSyslogTag
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	return &SyslogSink{
+		network:  network,
+		address:  address,
+		tag:      syslogHeaderField(tag, 48),
+		hostname: syslogHeaderField(hostname, 255),
+	}, nil
+}
+
+// Formats an entry as a RFC 5424 message
+func (sink *SyslogSink) Format(entry *Entry) string {
+	priority := syslogFacility*8 + syslogSeverity(entry.Level)
+
+	data := fmt.Sprintf(`job@%d id="%s" gid="%d" nid="%d" level="%d"`, syslogEnterprise,
+		syslogParamEscaper.Replace(entry.JobID), entry.Gid, entry.Nid, entry.Level)
+	//the MSGID may be cut short, the whole command is kept here
+	if entry.Cmd != "" {
+		data += fmt.Sprintf(` cmd="%s"`, syslogParamEscaper.Replace(entry.Cmd))
+	}
+	data = "[" + data + "]"
+
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s", priority,
+		entry.Time().UTC().Format("2006-01-02T15:04:05.000Z07:00"), sink.hostname, sink.tag,
+		os.Getpid(), syslogHeaderField(entry.Cmd, 32), data, entry.Message)
+}
+
+func (sink *SyslogSink) Write(entries []*Entry) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	for _, entry := range entries {
+		message := sink.Format(entry)
+		if sink.network == "unix" || sink.network == "tcp" {
+			message = syslogLineEscaper.Replace(message) + "\n"
+		}
+
+		if err := sink.send(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends a message, reconnecting once if the connection went away
+func (sink *SyslogSink) send(message string) error {
+	for attempt := 0; ; attempt++ {
+		if sink.conn == nil {
+			conn, err := net.DialTimeout(sink.network, sink.address, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			sink.conn = conn
+		}
+
+		_, err := sink.conn.Write([]byte(message))
+		if err == nil {
+			return nil
+		}
+
+		sink.conn.Close()
+		sink.conn = nil
+		if attempt > 0 {
+			return err
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const DefaultWebhookTimeout = 10 * time.Second
+
+// Posts every batch of entries as a JSON array to a URL
+type WebhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// Headers are added to every request, like an Authorization the receiver expects
+func NewWebhookSink(url string, headers map[string]string, timeout time.Duration) *WebhookSink {
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+
+	return &WebhookSink{
+		url:     url,
+		headers: headers,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (sink *WebhookSink) Write(entries []*Entry) error {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", sink.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range sink.headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s answered %s", sink.url, response.Status)
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/amrhassan/agentcontroller2/agentdata"
 	"github.com/amrhassan/agentcontroller2/agentpoll"
 	"github.com/amrhassan/agentcontroller2/rest"
+	"github.com/amrhassan/agentcontroller2/retention"
 	"github.com/amrhassan/agentcontroller2/settings"
 )
 
@@ -59,11 +60,14 @@ func newPool(addr string, password string) *redis.Pool {
 }
 
 var pool *redis.Pool
-var redisData = redisdata.NewRedisData(pool)
+var redisData *redisdata.RedisData
 
-var commandStorage core.CommandStorage = redisdata.NewRedisCommandStorage(pool)
-var incomingCommands core.Incoming = redisData
-var commandLogger core.CommandLogger = redisData
+var commandStorage core.CommandStorage
+var incomingCommands core.Incoming
+var commandLogger core.CommandLogger
+var agentKeys core.AgentKeyStorage
+var agentTokens core.AgentTokenStorage
+var keeper *retention.Keeper
 
 
 
@@ -91,6 +95,11 @@ func sendResult(result *core.CommandResult) {
 	err := commandStorage.SetCommandResult(result)
 	if err != nil {
 		log.Println("[-] failed to publish command result: {}", err.Error())
+		return
+	}
+
+	if err := keeper.Finished(result.ID); err != nil {
+		log.Println("[-] failed to apply job retention:", err)
 	}
 }
 
@@ -103,6 +112,9 @@ func internalListAgents(cmd *core.Command) (interface{}, error) {
 
 var internals = map[string]func(*core.Command) (interface{}, error){
 	"list_agents": internalListAgents,
+	"agent_token_issue": internalIssueAgentToken,
+	"agent_token_revoke": internalRevokeAgentToken,
+	"purge_jobs": internalPurgeJobs,
 }
 
 func processInternalCommand(command *core.Command) {
@@ -120,6 +132,11 @@ func processInternalCommand(command *core.Command) {
 		if err != nil {
 			result.Data = err.Error()
 		} else {
+			secret, isSecret := data.(*secretResult)
+			if isSecret {
+				data = secret.value
+			}
+
 			serialized, err := json.Marshal(data)
 			if err != nil {
 				result.Data = err.Error()
@@ -127,6 +144,12 @@ func processInternalCommand(command *core.Command) {
 			result.State = "SUCCESS"
 			result.Data = string(serialized)
 			result.Level = 20
+
+			if isSecret {
+				sendSecretResult(result)
+				signalQueues(command.ID)
+				return
+			}
 		}
 	} else {
 		result.State = "UNKNOWN_CMD"
@@ -136,6 +159,27 @@ func processInternalCommand(command *core.Command) {
 	signalQueues(command.ID)
 }
 
+//sendSecretResult keeps a redacted copy of the result, the full one only goes through the result queue
+//of the client for a short while
+func sendSecretResult(result *core.CommandResult) {
+	redacted := *result
+	redacted.Data = redactedResultData
+
+	if err := redisData.RecordCommandResult(&redacted); err != nil {
+		log.Println("[-] failed to record command result:", err)
+		return
+	}
+
+	//the retention applies to the redacted result, the queue keeps its own short expiry
+	if err := keeper.Finished(result.ID); err != nil {
+		log.Println("[-] failed to apply job retention:", err)
+	}
+
+	if err := redisData.DeliverCommandResult(result, secretResultTTL); err != nil {
+		log.Println("[-] failed to deliver command result:", err)
+	}
+}
+
 func signalQueues(id string) {
 	err := redisData.SignalCommandAsQueued(id)
 	if err != nil {
@@ -156,10 +200,13 @@ func readSingleCmd() bool {
 	}
 
 	if command.Cmd == cmdInternal {
+		dispatchedCommands.Inc(routingInternal)
 		go processInternalCommand(command)
 		return true
 	}
 
+	received := time.Now()
+
 	//sort command to the consumer queue.
 	//either by role or by the gid/nid.
 	ids := list.New()
@@ -181,12 +228,14 @@ func readSingleCmd() bool {
 			sendResult(result)
 		} else {
 			if command.Fanout {
+				dispatchedCommands.Inc(routingFanout)
 				//fanning out.
 				for _, agent := range active {
 					ids.PushBack(agent)
 				}
 
 			} else {
+				dispatchedCommands.Inc(routingRole)
 				agent := active[rand.Intn(len(active))]
 				ids.PushBack(agent)
 			}
@@ -207,26 +256,48 @@ func readSingleCmd() bool {
 
 			sendResult(result)
 		} else {
-			ids.PushBack([]int{command.Gid, command.Nid})
+			dispatchedCommands.Inc(routingAgent)
+			ids.PushBack(core.AgentID{GID: uint(command.Gid), NID: uint(command.Nid)})
 		}
 	}
 
-	// push logs
-	if err := commandLogger.LogCommand(command); err != nil {
+	// push logs, never with a payload that is meant to be sealed
+	loggedCommand := command
+	if command.Encrypted {
+		redacted := *command
+		redacted.Data = ""
+		loggedCommand = &redacted
+	}
+
+	if err := commandLogger.LogCommand(loggedCommand); err != nil {
 		log.Println("[-] log push error: ", err)
 	}
 
 	//distribution to agents.
 	for e := ids.Front(); e != nil; e = e.Next() {
 		// push message to client queue
-		agent := e.Value.([]int)
-		gid := agent[0]
-		nid := agent[1]
+		agentID := e.Value.(core.AgentID)
 
-		log.Println("Dispatching message to", agent)
-		agentID := core.AgentID{GID: uint(gid), NID: uint(nid)}
+		log.Println("Dispatching message to", agentID)
 
-		err := commandStorage.QueueReceivedCommand(agentID, command)
+		agentCommand := command
+		if command.Encrypted {
+			agentCommand, err = sealCommand(agentID, command)
+			if err != nil {
+				log.Println("[-] failed to seal command for", agentID, err)
+				sendResult(&core.CommandResult{
+					ID:        command.ID,
+					Gid:       int(agentID.GID),
+					Nid:       int(agentID.NID),
+					State:     core.COMMAND_STATE_ERROR,
+					Data:      fmt.Sprintf("Failed to encrypt command: %v", err),
+					StartTime: int64(time.Duration(time.Now().UnixNano()) / time.Millisecond),
+				})
+				continue
+			}
+		}
+
+		err = commandStorage.QueueReceivedCommand(agentID, agentCommand)
 		if err != nil {
 			log.Println("[-] push error: ", err)
 		}
@@ -238,6 +309,10 @@ func readSingleCmd() bool {
 
 	}
 
+	if ids.Len() > 0 {
+		dispatchLatency.Observe(time.Since(received).Seconds())
+	}
+
 	signalQueues(command.ID)
 	return true
 }
@@ -254,7 +329,7 @@ func cmdreader() {
 
 
 var agentData = agentdata.NewAgentData()
-var pollDataStreamManager = agentpoll.NewManager(agentData, commandStorage)
+var pollDataStreamManager *agentpoll.PollDataStreamManager
 
 //StartSyncthingHubbleAgent start the builtin hubble agent required for Syncthing
 func StartSyncthingHubbleAgent(hubblePort int) {
@@ -306,19 +381,55 @@ func main() {
 
 	db.Close()
 
+	redisData = redisdata.NewRedisData(pool)
+	commandStorage = redisdata.NewRedisCommandStorage(pool)
+	incomingCommands = redisData
+	commandLogger = redisData
+	agentKeys = redisData
+	agentTokens = redisData
+	pollDataStreamManager = agentpoll.NewManager(agentData, commandStorage)
+	installQueueMetrics(pool)
+
 	restInterface := rest.NewRestInterface(pool, pollDataStreamManager, &globalSettings)
+	keeper = restInterface.Keeper()
+	go keeper.RunArchiver()
 
 	go cmdreader()
 
 	//start schedular.
-	scheduler := NewScheduler(pool)
+	scheduler := NewScheduler(pool, time.Duration(globalSettings.Scheduler.LeaseTimeout)*time.Second)
 	internals["scheduler_add"] = scheduler.Add
 	internals["scheduler_list"] = scheduler.List
+	internals["scheduler_status"] = scheduler.Status
 	internals["scheduler_remove"] = scheduler.Remove
+	internals["scheduler_at"] = scheduler.AddAt
+	internals["scheduler_get"] = scheduler.Get
+	internals["scheduler_pause"] = scheduler.Pause
+	internals["scheduler_resume"] = scheduler.Resume
+	internals["scheduler_history"] = scheduler.History
+	internals["scheduler_leader"] = scheduler.Leader
+
+	if err := scheduler.Reconcile(globalSettings.Schedule); err != nil {
+		log.Panicln("Invalid schedule in the configuration", err)
+	}
 
 	scheduler.Start()
 
-	hubbleAuth.Install(hubbleAuth.NewAcceptAllModule())
+	if globalSettings.EnrollmentEnabled() {
+		if err := installEnrollment(&globalSettings); err != nil {
+			log.Panicln("Unable to load the enrollment CA", err)
+		}
+	}
+
+	var hubbleTokens core.AgentTokenStorage
+	if globalSettings.Auth.AgentTokens {
+		hubbleTokens = agentTokens
+	}
+	var hubbleIdentities hubbleIdentities
+	if globalSettings.ClientIdentity.Enabled() {
+		hubbleIdentities = restInterface.HubbleSessions()
+	}
+	hubbleAuth.Install(newHubbleAuthModule(globalSettings.Hubble.Allow, hubbleTokens, hubbleIdentities))
 
 	// router.Static("/doc", "./doc")
 
@@ -326,17 +437,15 @@ func main() {
 	wg.Add(len(globalSettings.Listen))
 	for _, httpBinding := range globalSettings.Listen {
 		go func(httpBinding settings.HTTPBinding) {
-			server := &http.Server{Addr: httpBinding.Address, Handler: restInterface.Router()}
+			server := &http.Server{Addr: httpBinding.Address, Handler: restInterface.ListenerHandler(httpBinding)}
 			if httpBinding.TLSEnabled() {
-				server.TLSConfig = &tls.Config{}
-
-				if err := configureServerCertificates(httpBinding, server); err != nil {
-					log.Panicln("Unable to load the server certificates", err)
+				certificates, err := newCertificateStore(httpBinding)
+				if err != nil {
+					log.Panicln("Unable to load the server certificates, clientCA's or CRL's", err)
 				}
+				go certificates.watch()
 
-				if err := configureClientCertificates(httpBinding, server); err != nil {
-					log.Panicln("Unable to load the clientCA's", err)
-				}
+				server.TLSConfig = &tls.Config{GetConfigForClient: certificates.configForClient}
 
 				ln, err := net.Listen("tcp", server.Addr)
 				if err != nil {
@@ -0,0 +1,319 @@
+// Metrics about the controller itself, exposed in the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// The registry the controller metrics are declared in
+var Default = NewRegistry()
+
+// A single value of a metric, with its label values in the order of the metric label names
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type metric interface {
+	expose(out *bufio.Writer)
+}
+
+// Holds metrics and exposes them, in the order they were declared
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (registry *Registry) add(metric metric) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.metrics = append(registry.metrics, metric)
+}
+
+// Writes all the metrics in the Prometheus text format
+func (registry *Registry) Expose(w io.Writer) error {
+	registry.lock.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.lock.Unlock()
+
+	out := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		metric.expose(out)
+	}
+	return out.Flush()
+}
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	registry.Expose(w)
+}
+
+// The name, help and label names shared by all the metric types
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (desc *desc) header(out *bufio.Writer) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", desc.name, desc.help, desc.name, desc.kind)
+}
+
+func (desc *desc) sample(out *bufio.Writer, suffix string, values []string, extra string, value float64) {
+	pairs := make([]string, 0, len(values)+1)
+	for i, value := range values {
+		pairs = append(pairs, desc.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	out.WriteString(desc.name + suffix)
+	if len(pairs) > 0 {
+		out.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	out.WriteString(" " + formatValue(value) + "\n")
+}
+
+func (desc *desc) key(values []string) string {
+	if len(values) != len(desc.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", desc.name, len(desc.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// Values per set of label values, for counters and gauges
+type values struct {
+	desc
+	lock   sync.Mutex
+	series map[string]*Sample
+}
+
+func newValues(registry *Registry, kind string, name string, help string, labels []string) *values {
+	values := &values{
+		desc:   desc{name: name, help: help, kind: kind, labels: labels},
+		series: make(map[string]*Sample),
+	}
+	registry.add(values)
+	return values
+}
+
+func (values *values) add(delta float64, labels []string) {
+	key := values.key(labels)
+
+	values.lock.Lock()
+	defer values.lock.Unlock()
+
+	sample, ok := values.series[key]
+	if !ok {
+		sample = &Sample{Labels: append([]string(nil), labels...)}
+		values.series[key] = sample
+	}
+	sample.Value += delta
+}
+
+func (values *values) set(value float64, labels []string) {
+	key := values.key(labels)
+
+	values.lock.Lock()
+	defer values.lock.Unlock()
+
+	values.series[key] = &Sample{Labels: append([]string(nil), labels...), Value: value}
+}
+
+func (values *values) expose(out *bufio.Writer) {
+	values.lock.Lock()
+	keys := make([]string, 0, len(values.series))
+	for key := range values.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	samples := make([]Sample, 0, len(keys))
+	for _, key := range keys {
+		samples = append(samples, *values.series[key])
+	}
+	values.lock.Unlock()
+
+	values.header(out)
+	for _, sample := range samples {
+		values.sample(out, "", sample.Labels, "", sample.Value)
+	}
+}
+
+// A value that only goes up
+type Counter struct {
+	values *values
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+func (registry *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{values: newValues(registry, typeCounter, name, help, labels)}
+}
+
+func (counter *Counter) Inc(labels ...string) {
+	counter.values.add(1, labels)
+}
+
+func (counter *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		panic("counters can't go down")
+	}
+	counter.values.add(delta, labels)
+}
+
+// A value that goes up and down
+type Gauge struct {
+	values *values
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+func (registry *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{values: newValues(registry, typeGauge, name, help, labels)}
+}
+
+func (gauge *Gauge) Set(value float64, labels ...string) {
+	gauge.values.set(value, labels)
+}
+
+func (gauge *Gauge) Inc(labels ...string) {
+	gauge.values.add(1, labels)
+}
+
+func (gauge *Gauge) Dec(labels ...string) {
+	gauge.values.add(-1, labels)
+}
+
+// A metric whose samples are collected every time the metrics are exposed
+type Func struct {
+	desc
+	collect func() []Sample
+}
+
+// A gauge collected from elsewhere, like the length of a queue
+func NewGaugeFunc(name string, help string, labels []string, collect func() []Sample) *Func {
+	return Default.NewGaugeFunc(name, help, labels, collect)
+}
+
+func (registry *Registry) NewGaugeFunc(name string, help string, labels []string, collect func() []Sample) *Func {
+	return registry.newFunc(typeGauge, name, help, labels, collect)
+}
+
+// A counter that is kept elsewhere
+func NewCounterFunc(name string, help string, labels []string, collect func() []Sample) *Func {
+	return Default.NewCounterFunc(name, help, labels, collect)
+}
+
+func (registry *Registry) NewCounterFunc(name string, help string, labels []string, collect func() []Sample) *Func {
+	return registry.newFunc(typeCounter, name, help, labels, collect)
+}
+
+func (registry *Registry) newFunc(kind string, name string, help string, labels []string, collect func() []Sample) *Func {
+	metric := &Func{
+		desc:    desc{name: name, help: help, kind: kind, labels: labels},
+		collect: collect,
+	}
+	registry.add(metric)
+	return metric
+}
+
+func (metric *Func) expose(out *bufio.Writer) {
+	metric.header(out)
+	for _, sample := range metric.collect() {
+		metric.key(sample.Labels)
+		metric.sample(out, "", sample.Labels, "", sample.Value)
+	}
+}
+
+// Counts observations in cumulative buckets of upper bounds, along with their sum
+type Histogram struct {
+	desc
+	buckets []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Upper bounds in seconds fit for latencies from a millisecond to ten seconds
+var LatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{
+		desc:    desc{name: name, help: help, kind: typeHistogram},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	registry.add(histogram)
+	return histogram
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+func (histogram *Histogram) expose(out *bufio.Writer) {
+	histogram.lock.Lock()
+	counts := append([]uint64(nil), histogram.counts...)
+	count, sum := histogram.count, histogram.sum
+	histogram.lock.Unlock()
+
+	histogram.header(out)
+	for i, bound := range histogram.buckets {
+		histogram.sample(out, "_bucket", nil, `le="`+formatValue(bound)+`"`, float64(counts[i]))
+	}
+	histogram.sample(out, "_bucket", nil, `le="+Inf"`, float64(count))
+	histogram.sample(out, "_sum", nil, "", sum)
+	histogram.sample(out, "_count", nil, "", float64(count))
+}
@@ -0,0 +1,55 @@
+package metrics_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryExposesTextFormat(t *testing.T) {
+
+	registry := metrics.NewRegistry()
+
+	dispatched := registry.NewCounter("dispatched_total", "Commands dispatched.", "routing")
+	dispatched.Inc("role")
+	dispatched.Inc("role")
+	dispatched.Add(3, "gid_nid")
+
+	polls := registry.NewGauge("long_polls", "Agents waiting for a command.")
+	polls.Inc()
+	polls.Inc()
+	polls.Dec()
+
+	registry.NewGaugeFunc("queue_depth", "Commands waiting.", []string{"queue"}, func() []metrics.Sample {
+		return []metrics.Sample{{Labels: []string{`cmds"1`}, Value: 4}}
+	})
+
+	latency := registry.NewHistogram("latency_seconds", "Dispatch latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(3)
+
+	var out bytes.Buffer
+	assert.NoError(t, registry.Expose(&out))
+
+	assert.Equal(t, `# HELP dispatched_total Commands dispatched.
+# TYPE dispatched_total counter
+dispatched_total{routing="gid_nid"} 3
+dispatched_total{routing="role"} 2
+# HELP long_polls Agents waiting for a command.
+# TYPE long_polls gauge
+long_polls 1
+# HELP queue_depth Commands waiting.
+# TYPE queue_depth gauge
+queue_depth{queue="cmds\"1"} 4
+# HELP latency_seconds Dispatch latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.55
+latency_seconds_count 3
+`, out.String())
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+//fakeRedis keeps the few redis structures the controller uses in memory, scripts are emulated
+type fakeRedis struct {
+	lock      sync.Mutex
+	strings   map[string]string
+	hashes    map[string]map[string]string
+	lists     map[string][]string
+	zsets     map[string]map[string]float64
+	ttls      map[string]int64
+	published []string
+	//subscribers are the connections subscribed to each channel
+	subscribers map[string]map[*fakeConn]bool
+	//failures makes the commands it holds fail with the given error
+	failures map[string]error
+	//deadlines are when the keys set with PX or PEXPIRE expire
+	deadlines map[string]time.Time
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		lists:   make(map[string][]string),
+		zsets:   make(map[string]map[string]float64),
+		ttls:    make(map[string]int64),
+
+		subscribers: make(map[string]map[*fakeConn]bool),
+		failures:    make(map[string]error),
+		deadlines:   make(map[string]time.Time),
+	}
+}
+
+func (fake *fakeRedis) pool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle: 10,
+		Dial: func() (redis.Conn, error) {
+			return &fakeConn{redis: fake}, nil
+		},
+	}
+}
+
+func (fake *fakeRedis) hash(key string) map[string]string {
+	hash, ok := fake.hashes[key]
+	if !ok {
+		hash = make(map[string]string)
+		fake.hashes[key] = hash
+	}
+	return hash
+}
+
+func (fake *fakeRedis) zset(key string) map[string]float64 {
+	zset, ok := fake.zsets[key]
+	if !ok {
+		zset = make(map[string]float64)
+		fake.zsets[key] = zset
+	}
+	return zset
+}
+
+func (fake *fakeRedis) exists(key string) bool {
+	_, isString := fake.strings[key]
+	return isString || len(fake.hashes[key]) > 0 || len(fake.lists[key]) > 0 || len(fake.zsets[key]) > 0
+}
+
+func (fake *fakeRedis) del(key string) int64 {
+	existed := fake.exists(key)
+	delete(fake.strings, key)
+	delete(fake.hashes, key)
+	delete(fake.lists, key)
+	delete(fake.zsets, key)
+	delete(fake.ttls, key)
+	delete(fake.deadlines, key)
+	if existed {
+		return 1
+	}
+	return 0
+}
+
+//expire deletes the keys whose deadline passed
+func (fake *fakeRedis) expire() {
+	now := time.Now()
+	for key, deadline := range fake.deadlines {
+		if now.After(deadline) {
+			fake.del(key)
+		}
+	}
+}
+
+//pexpire sets the ttl of the key in milliseconds, after which it expires
+func (fake *fakeRedis) pexpire(key string, ttl string) {
+	milliseconds, _ := strconv.ParseInt(ttl, 10, 64)
+	fake.ttls[key] = milliseconds
+	fake.deadlines[key] = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
+}
+
+func bulk(value string) interface{} {
+	return []byte(value)
+}
+
+func listIndex(index int, length int) int {
+	if index < 0 {
+		index += length
+	}
+	return index
+}
+
+func parseScore(value string) float64 {
+	switch value {
+	case "-inf":
+		return -1e308
+	case "+inf", "inf":
+		return 1e308
+	}
+	score, _ := strconv.ParseFloat(strings.TrimPrefix(value, "("), 64)
+	return score
+}
+
+func (fake *fakeRedis) do(command string, args []string) (interface{}, error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	if err := fake.failures[strings.ToUpper(command)]; err != nil {
+		return nil, err
+	}
+	fake.expire()
+
+	switch strings.ToUpper(command) {
+	case "", "MULTI", "DISCARD":
+		return "OK", nil
+	case "EXISTS":
+		if fake.exists(args[0]) {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "ECHO":
+		return bulk(args[0]), nil
+	case "GET":
+		value, ok := fake.strings[args[0]]
+		if !ok {
+			return nil, nil
+		}
+		return bulk(value), nil
+	case "SET":
+		nx := false
+		for _, option := range args[2:] {
+			nx = nx || strings.ToUpper(option) == "NX"
+		}
+		if _, ok := fake.strings[args[0]]; ok && nx {
+			return nil, nil
+		}
+		fake.del(args[0])
+		fake.strings[args[0]] = args[1]
+		for i := 2; i+1 < len(args); i++ {
+			if strings.ToUpper(args[i]) == "PX" {
+				fake.pexpire(args[0], args[i+1])
+			}
+		}
+		return "OK", nil
+	case "DEL":
+		var deleted int64
+		for _, key := range args {
+			deleted += fake.del(key)
+		}
+		return deleted, nil
+	case "EXPIRE", "PEXPIRE":
+		if !fake.exists(args[0]) {
+			return int64(0), nil
+		}
+		if strings.ToUpper(command) == "PEXPIRE" {
+			fake.pexpire(args[0], args[1])
+			return int64(1), nil
+		}
+		ttl, _ := strconv.ParseInt(args[1], 10, 64)
+		fake.ttls[args[0]] = ttl
+		return int64(1), nil
+	case "PERSIST":
+		if _, ok := fake.ttls[args[0]]; !ok {
+			return int64(0), nil
+		}
+		delete(fake.ttls, args[0])
+		return int64(1), nil
+	case "PTTL":
+		return fake.ttls[args[0]], nil
+	case "HGET":
+		value, ok := fake.hashes[args[0]][args[1]]
+		if !ok {
+			return nil, nil
+		}
+		return bulk(value), nil
+	case "HSET":
+		_, existed := fake.hash(args[0])[args[1]]
+		fake.hash(args[0])[args[1]] = args[2]
+		if existed {
+			return int64(0), nil
+		}
+		return int64(1), nil
+	case "HDEL":
+		var deleted int64
+		for _, field := range args[1:] {
+			if _, ok := fake.hashes[args[0]][field]; ok {
+				delete(fake.hashes[args[0]], field)
+				deleted++
+			}
+		}
+		return deleted, nil
+	case "HEXISTS":
+		if _, ok := fake.hashes[args[0]][args[1]]; ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "HINCRBY":
+		current, _ := strconv.ParseInt(fake.hashes[args[0]][args[1]], 10, 64)
+		delta, _ := strconv.ParseInt(args[2], 10, 64)
+		fake.hash(args[0])[args[1]] = strconv.FormatInt(current+delta, 10)
+		return current + delta, nil
+	case "HGETALL":
+		var values []interface{}
+		for field, value := range fake.hashes[args[0]] {
+			values = append(values, bulk(field), bulk(value))
+		}
+		return values, nil
+	case "HSCAN":
+		var values []interface{}
+		for field, value := range fake.hashes[args[0]] {
+			values = append(values, bulk(field), bulk(value))
+		}
+		return []interface{}{bulk("0"), values}, nil
+	case "LPUSH":
+		for _, value := range args[1:] {
+			fake.lists[args[0]] = append([]string{value}, fake.lists[args[0]]...)
+		}
+		return int64(len(fake.lists[args[0]])), nil
+	case "RPUSH":
+		fake.lists[args[0]] = append(fake.lists[args[0]], args[1:]...)
+		return int64(len(fake.lists[args[0]])), nil
+	case "LPOP":
+		list := fake.lists[args[0]]
+		if len(list) == 0 {
+			return nil, nil
+		}
+		fake.lists[args[0]] = list[1:]
+		return bulk(list[0]), nil
+	case "LRANGE", "LTRIM":
+		list := fake.lists[args[0]]
+		start, _ := strconv.Atoi(args[1])
+		stop, _ := strconv.Atoi(args[2])
+		start, stop = listIndex(start, len(list)), listIndex(stop, len(list))
+		if start < 0 {
+			start = 0
+		}
+		if stop >= len(list) {
+			stop = len(list) - 1
+		}
+		var selected []string
+		if start <= stop {
+			selected = append(selected, list[start:stop+1]...)
+		}
+		if strings.ToUpper(command) == "LTRIM" {
+			fake.lists[args[0]] = selected
+			return "OK", nil
+		}
+		values := make([]interface{}, 0, len(selected))
+		for _, value := range selected {
+			values = append(values, bulk(value))
+		}
+		return values, nil
+	case "ZADD":
+		score, _ := strconv.ParseFloat(args[1], 64)
+		fake.zset(args[0])[args[2]] = score
+		return int64(1), nil
+	case "ZREM":
+		if _, ok := fake.zsets[args[0]][args[1]]; ok {
+			delete(fake.zsets[args[0]], args[1])
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "ZRANGEBYSCORE", "ZREMRANGEBYSCORE":
+		min, max := parseScore(args[1]), parseScore(args[2])
+		var members []string
+		for member, score := range fake.zsets[args[0]] {
+			if score >= min && score <= max {
+				members = append(members, member)
+			}
+		}
+		sort.Strings(members)
+		if strings.ToUpper(command) == "ZREMRANGEBYSCORE" {
+			for _, member := range members {
+				delete(fake.zsets[args[0]], member)
+			}
+			return int64(len(members)), nil
+		}
+		withScores := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "WITHSCORES":
+				withScores = true
+			case "LIMIT":
+				offset, _ := strconv.Atoi(args[i+1])
+				count, _ := strconv.Atoi(args[i+2])
+				if offset > len(members) {
+					offset = len(members)
+				}
+				members = members[offset:]
+				if count >= 0 && count < len(members) {
+					members = members[:count]
+				}
+				i += 2
+			}
+		}
+		values := make([]interface{}, 0, len(members))
+		for _, member := range members {
+			values = append(values, bulk(member))
+			if withScores {
+				values = append(values, bulk(strconv.FormatFloat(fake.zsets[args[0]][member], 'f', -1, 64)))
+			}
+		}
+		return values, nil
+	case "PUBLISH":
+		fake.published = append(fake.published, args[0]+" "+args[1])
+		for conn := range fake.subscribers[args[0]] {
+			conn.messages <- []interface{}{bulk("message"), bulk(args[0]), bulk(args[1])}
+		}
+		return int64(len(fake.subscribers[args[0]])), nil
+	case "EVALSHA":
+		return nil, redis.Error("NOSCRIPT fake redis only evaluates scripts by source")
+	case "EVAL":
+		return fake.eval(args[0], args[2:])
+	default:
+		return nil, fmt.Errorf("fake redis doesn't know %s", command)
+	}
+}
+
+//eval emulates the scripts of the scheduler, recognized by their source
+func (fake *fakeRedis) eval(source string, keysAndArgs []string) (interface{}, error) {
+	switch {
+	case strings.Contains(source, "HEXISTS"):
+		//updateScheduleScript
+		hash, id, spec := keysAndArgs[0], keysAndArgs[1], keysAndArgs[2]
+		if _, ok := fake.hashes[hash][id]; !ok {
+			return int64(0), nil
+		}
+		fake.hash(hash)[id] = spec
+		return int64(1), nil
+	case strings.Contains(source, "PEXPIRE"):
+		//renewLeaseScript
+		if fake.strings[keysAndArgs[0]] != keysAndArgs[1] {
+			return int64(0), nil
+		}
+		fake.pexpire(keysAndArgs[0], keysAndArgs[2])
+		return int64(1), nil
+	case strings.Contains(source, `"RPUSH", KEYS[2]`):
+		//leaderPushScript
+		leader, queue, schedule := keysAndArgs[0], keysAndArgs[1], keysAndArgs[2]
+		instance, dump, once := keysAndArgs[3], keysAndArgs[4], keysAndArgs[5]
+		if fake.strings[leader] != instance {
+			return int64(0), nil
+		}
+		if once != "" {
+			if _, ok := fake.hashes[schedule][once]; !ok {
+				return int64(-1), nil
+			}
+			delete(fake.hashes[schedule], once)
+		}
+		fake.lists[queue] = append(fake.lists[queue], dump)
+		return int64(1), nil
+	default:
+		return nil, errors.New("fake redis doesn't know this script")
+	}
+}
+
+//fakeConn runs every command right away, the replies of pipelined commands are returned by EXEC
+type fakeConn struct {
+	redis   *fakeRedis
+	pending []interface{}
+	//once subscribed, replies and published messages are received from messages
+	messages chan interface{}
+	channels []string
+}
+
+//pubsub handles the commands of a subscribed connection, their replies are received later
+func (conn *fakeConn) pubsub(command string, args []string) bool {
+	fake := conn.redis
+
+	switch {
+	case command == "SUBSCRIBE":
+		fake.lock.Lock()
+		defer fake.lock.Unlock()
+		if conn.messages == nil {
+			conn.messages = make(chan interface{}, 100)
+		}
+		for _, channel := range args {
+			if fake.subscribers[channel] == nil {
+				fake.subscribers[channel] = make(map[*fakeConn]bool)
+			}
+			fake.subscribers[channel][conn] = true
+			conn.channels = append(conn.channels, channel)
+			conn.messages <- []interface{}{bulk("subscribe"), bulk(channel), int64(len(conn.channels))}
+		}
+		return true
+	case conn.messages == nil:
+		return false
+	case command == "UNSUBSCRIBE":
+		fake.lock.Lock()
+		defer fake.lock.Unlock()
+		channels := args
+		if len(channels) == 0 {
+			channels = conn.channels
+		}
+		if len(channels) == 0 {
+			conn.messages <- []interface{}{bulk("unsubscribe"), nil, int64(0)}
+		}
+		for _, channel := range append([]string(nil), channels...) {
+			delete(fake.subscribers[channel], conn)
+			for i, subscribed := range conn.channels {
+				if subscribed == channel {
+					conn.channels = append(conn.channels[:i], conn.channels[i+1:]...)
+					break
+				}
+			}
+			conn.messages <- []interface{}{bulk("unsubscribe"), bulk(channel), int64(len(conn.channels))}
+		}
+		return true
+	case command == "PUNSUBSCRIBE":
+		conn.messages <- []interface{}{bulk("punsubscribe"), nil, int64(len(conn.channels))}
+		return true
+	case command == "PING":
+		data := ""
+		if len(args) > 0 {
+			data = args[0]
+		}
+		conn.messages <- []interface{}{bulk("pong"), bulk(data)}
+		return true
+	case command == "ECHO":
+		conn.messages <- bulk(args[0])
+		return true
+	default:
+		return false
+	}
+}
+
+func stringArgs(args []interface{}) []string {
+	values := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch value := arg.(type) {
+		case []byte:
+			values = append(values, string(value))
+		default:
+			values = append(values, fmt.Sprint(value))
+		}
+	}
+	return values
+}
+
+func (conn *fakeConn) Close() error {
+	return nil
+}
+
+func (conn *fakeConn) Err() error {
+	return nil
+}
+
+func (conn *fakeConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if strings.ToUpper(command) == "EXEC" {
+		replies := conn.pending
+		conn.pending = nil
+		return replies, nil
+	}
+	conn.pending = nil
+	return conn.redis.do(command, stringArgs(args))
+}
+
+func (conn *fakeConn) Send(command string, args ...interface{}) error {
+	if conn.pubsub(strings.ToUpper(command), stringArgs(args)) {
+		return nil
+	}
+	reply, err := conn.redis.do(command, stringArgs(args))
+	if err != nil {
+		return err
+	}
+	if strings.ToUpper(command) != "MULTI" {
+		conn.pending = append(conn.pending, reply)
+	}
+	return nil
+}
+
+func (conn *fakeConn) Flush() error {
+	return nil
+}
+
+func (conn *fakeConn) Receive() (interface{}, error) {
+	if len(conn.pending) == 0 && conn.messages != nil {
+		return <-conn.messages, nil
+	}
+	if len(conn.pending) == 0 {
+		return nil, errors.New("fake redis has no pending reply")
+	}
+	reply := conn.pending[0]
+	conn.pending = conn.pending[1:]
+	return reply, nil
+}
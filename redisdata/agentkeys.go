@@ -0,0 +1,33 @@
+package redisdata
+import (
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/garyburd/redigo/redis"
+	"fmt"
+)
+
+func (redisData *RedisData) SetPublicKey(id core.AgentID, key []byte) error {
+	db := redisData.pool.Get()
+	defer db.Close()
+
+	_, err := db.Do("HSET", hashAgentKeys, agentField(id), key)
+	if err != nil {
+		return fmt.Errorf("%s: %v", redisErrorMessage, err)
+	}
+
+	return nil
+}
+
+func (redisData *RedisData) PublicKey(id core.AgentID) ([]byte, error) {
+	db := redisData.pool.Get()
+	defer db.Close()
+
+	key, err := redis.Bytes(db.Do("HGET", hashAgentKeys, agentField(id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", redisErrorMessage, err)
+	}
+
+	return key, nil
+}
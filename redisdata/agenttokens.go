@@ -0,0 +1,62 @@
+package redisdata
+import (
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/garyburd/redigo/redis"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+const agentTokenSize = 32
+
+func hashAgentToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (redisData *RedisData) IssueToken(id core.AgentID) (string, error) {
+	raw := make([]byte, agentTokenSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	db := redisData.pool.Get()
+	defer db.Close()
+
+	_, err := db.Do("HSET", hashAgentTokens, agentField(id), hashAgentToken(token))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", redisErrorMessage, err)
+	}
+
+	return token, nil
+}
+
+func (redisData *RedisData) RevokeToken(id core.AgentID) (bool, error) {
+	db := redisData.pool.Get()
+	defer db.Close()
+
+	deleted, err := redis.Int(db.Do("HDEL", hashAgentTokens, agentField(id)))
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", redisErrorMessage, err)
+	}
+
+	return deleted > 0, nil
+}
+
+func (redisData *RedisData) VerifyToken(id core.AgentID, token string) (bool, error) {
+	db := redisData.pool.Get()
+	defer db.Close()
+
+	stored, err := redis.String(db.Do("HGET", hashAgentTokens, agentField(id)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", redisErrorMessage, err)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(hashAgentToken(token))) == 1, nil
+}
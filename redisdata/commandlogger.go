@@ -1,11 +1,19 @@
 package redisdata
-import "github.com/amrhassan/agentcontroller2/core"
+import (
+	"github.com/amrhassan/agentcontroller2/core"
+	"encoding/json"
+)
 
 
 func (redisData *RedisData) LogCommand(command *core.Command) error {
 	db := redisData.pool.Get()
 	defer db.Close()
 
-	_, err := db.Do("LPUSH", "joblog", command)
+	commandJson, err := json.Marshal(command)
+	if err != nil {
+		panic("Failed to marshal a Command!")
+	}
+
+	_, err = db.Do("LPUSH", "joblog", commandJson)
 	return err
 }
@@ -28,7 +28,12 @@ func (store *RedisCommandStorage) QueueReceivedCommand(agentID core.AgentID, com
 	db := store.pool.Get()
 	defer db.Close()
 
-	_, err := db.Do("RPUSH", getAgentQueue(agentID), command)
+	commandJson, err := json.Marshal(command)
+	if err != nil {
+		panic("Failed to marshal a Command!")
+	}
+
+	_, err = db.Do("RPUSH", getAgentQueue(agentID), commandJson)
 	if err != nil {
 		return fmt.Errorf("%s: %v", redisErrorMessage, err)
 	}
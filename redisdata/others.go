@@ -53,4 +53,42 @@ func (redisData *RedisData) SignalCommandAsQueued(commandID string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+// Stores the result of a command in its jobresult hash only, without handing it to the waiting client
+func (redisData *RedisData) RecordCommandResult(result *core.CommandResult) error {
+	db := redisData.pool.Get()
+	defer db.Close()
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Do("HSET", fmt.Sprintf(hashCmdResults, result.ID), fmt.Sprintf("%d:%d", result.Gid, result.Nid), data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", redisErrorMessage, err)
+	}
+
+	return nil
+}
+
+// Hands the result of a command to the waiting client through its result queue only, the queue expires after ttl
+func (redisData *RedisData) DeliverCommandResult(result *core.CommandResult, ttl time.Duration) error {
+	db := redisData.pool.Get()
+	defer db.Close()
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	queue := getAgentResultQueue(result)
+	db.Send("MULTI")
+	db.Send("RPUSH", queue, data)
+	db.Send("EXPIRE", queue, int64(ttl/time.Second))
+	if _, err := db.Do("EXEC"); err != nil {
+		return fmt.Errorf("%s: %v", redisErrorMessage, err)
+	}
+
+	return nil
+}
@@ -14,6 +14,8 @@ type RedisData struct {
 // 	- core.Incoming
 //	- core.CommandStorage
 //	- core.CommandLogger
+//	- core.AgentKeyStorage
+//	- core.AgentTokenStorage
 func NewRedisData(redisPool *redis.Pool) *RedisData {
 	return &RedisData{
 		pool: redisPool,
@@ -25,8 +27,15 @@ const (
 	cmdQueueCmdQueued         = "cmd.%s.queued"
 	cmdQueueAgentResponse     = "cmd.%s.%d.%d"
 	hashCmdResults            = "jobresult:%s"
+	hashAgentKeys             = "agent.keys"
+	hashAgentTokens           = "agent.tokens"
 )
 
 func getAgentQueue(agentID core.AgentID) string {
 	return fmt.Sprintf("cmds:%d:%d", agentID.GID, agentID.NID)
-}
\ No newline at end of file
+}
+
+// The field under which per-Agent data is kept in Redis hashes
+func agentField(agentID core.AgentID) string {
+	return fmt.Sprintf("%d:%d", agentID.GID, agentID.NID)
+}
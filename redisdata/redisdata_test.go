@@ -11,4 +11,12 @@ func TestImplementsCoreIncoming(t *testing.T) {
 
 func TestImplementsCoreCommandLogger(t *testing.T) {
 	assert.Implements(t, (*core.CommandLogger)(nil), new(RedisData))
-}
\ No newline at end of file
+}
+
+func TestImplementsCoreAgentKeyStorage(t *testing.T) {
+	assert.Implements(t, (*core.AgentKeyStorage)(nil), new(RedisData))
+}
+
+func TestImplementsCoreAgentTokenStorage(t *testing.T) {
+	assert.Implements(t, (*core.AgentTokenStorage)(nil), new(RedisData))
+}
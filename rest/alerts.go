@@ -0,0 +1,60 @@
+package rest
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/amrhassan/agentcontroller2/alerts"
+	"github.com/pborman/uuid"
+)
+
+const alertsChannel = "controller.alerts"
+
+// Publishes an alert event, and dispatches the remediation command of the rule to the agent when it fires.
+// The agent is the one that posted the offending point, never one named in its tags.
+func (rest *RestInterface) alert(rule *alerts.Rule, event *alerts.Event) {
+	log.Printf("[alert] %s %s for %s (%s %s %v, value %v)\n", event.Rule, event.State,
+		event.Measurement, event.Field, event.Op, event.Threshold, event.Value)
+
+	db := rest.pool.Get()
+	defer db.Close()
+
+	dump, err := json.Marshal(event)
+	if err != nil {
+		log.Println("[-] cannot serialize alert:", err)
+		return
+	}
+
+	if _, err := db.Do("PUBLISH", alertsChannel, dump); err != nil {
+		log.Println("[-] cannot publish alert:", err)
+	}
+
+	if event.State != alerts.StateFiring || rule.Remediation == nil {
+		return
+	}
+
+	if event.Agent == nil {
+		log.Println("[-] no agent to remediate alert", event.Rule, "on", event.Measurement)
+		return
+	}
+	gid, nid := event.Agent.GID, event.Agent.NID
+
+	command := make(map[string]interface{}, len(rule.Remediation)+3)
+	for key, value := range rule.Remediation {
+		command[key] = value
+	}
+	command["id"] = uuid.New()
+	command["gid"] = gid
+	command["nid"] = nid
+
+	dump, err = json.Marshal(command)
+	if err != nil {
+		log.Println("[-] cannot serialize remediation:", err)
+		return
+	}
+
+	log.Println("[alert] dispatching remediation", command["id"], "of", event.Rule, "to", gid, nid)
+	if _, err := db.Do("RPUSH", cmdQueueMain, dump); err != nil {
+		log.Println("[-] cannot dispatch remediation:", err)
+	}
+}
@@ -0,0 +1,68 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/alerts"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemediationGoesToTheReportingAgent(t *testing.T) {
+
+	recording := &recordingRedis{}
+	rest := &RestInterface{pool: recording.pool()}
+
+	evaluator, err := alerts.NewEvaluator(&recordingSink{}, []alerts.Rule{{
+		Name:        "cpu-high",
+		Measurement: "cpu",
+		Op:          ">",
+		Threshold:   90,
+		Remediation: map[string]interface{}{"cmd": "execute"},
+	}}, rest.alert)
+	assert.NoError(t, err)
+	rest.statsSink = evaluator
+
+	router := gin.New()
+	router.POST("/:gid/:nid/stats", rest.stats)
+
+	//the tags name another agent, the remediation still goes to the one that posted
+	r, err := http.NewRequest("POST", "/1/2/stats", strings.NewReader("cpu,gid=3,nid=4 value=95"))
+	assert.NoError(t, err)
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var pushed []string
+	for _, command := range recording.recorded() {
+		if strings.HasPrefix(command, "RPUSH "+cmdQueueMain+" ") {
+			pushed = append(pushed, strings.TrimPrefix(command, "RPUSH "+cmdQueueMain+" "))
+		}
+	}
+	if assert.Len(t, pushed, 1) {
+		command := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(pushed[0]), &command))
+		assert.Equal(t, "execute", command["cmd"])
+		assert.Equal(t, float64(1), command["gid"])
+		assert.Equal(t, float64(2), command["nid"])
+	}
+}
+
+func TestRemediationNeedsAnAgent(t *testing.T) {
+
+	recording := &recordingRedis{}
+	rest := &RestInterface{pool: recording.pool()}
+
+	rule := &alerts.Rule{Name: "cpu-high", Remediation: map[string]interface{}{"cmd": "execute"}}
+	rest.alert(rule, &alerts.Event{Rule: "cpu-high", State: alerts.StateFiring,
+		Tags: map[string]string{"gid": "3", "nid": "4"}})
+
+	for _, command := range recording.recorded() {
+		assert.False(t, strings.HasPrefix(command, "RPUSH"), command)
+	}
+}
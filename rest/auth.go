@@ -0,0 +1,105 @@
+package rest
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/amrhassan/agentcontroller2/core"
+	"net"
+	"net/http"
+	"strings"
+	"log"
+)
+
+// The builtin hubble agent connects over loopback as this Agent, and has no way to present a token
+var builtinAgentID = core.AgentID{GID: 0, NID: 0}
+
+// The only route the builtin hubble agent uses
+const builtinAgentPath = "/0/0/hubble"
+
+// Rejects requests on the Agent routes that don't carry the bearer token issued to that Agent
+func (rest *RestInterface) authenticateAgent(c *gin.Context) {
+
+	id := agentInformation(c)
+
+	if id == builtinAgentID && c.Request.URL.Path == builtinAgentPath && isLoopback(c.Request) {
+		c.Next()
+		return
+	}
+
+	token := bearerToken(c.Request)
+	if token == "" {
+		log.Printf("[-] gin: missing agent token (gid: %d, nid: %d)\n", id.GID, id.NID)
+		c.JSON(http.StatusUnauthorized, "unauthorized")
+		c.Abort()
+		return
+	}
+
+	valid, err := rest.agentTokens.VerifyToken(id, token)
+	if err != nil {
+		log.Println("[-] cannot verify agent token:", err)
+		c.JSON(http.StatusInternalServerError, "error")
+		c.Abort()
+		return
+	}
+
+	if !valid {
+		log.Printf("[-] gin: invalid agent token (gid: %d, nid: %d)\n", id.GID, id.NID)
+		c.JSON(http.StatusUnauthorized, "unauthorized")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// Operator routes need the operator token, or a loopback client if there is none in the settings
+func (rest *RestInterface) operatorAuthorized(request *http.Request) bool {
+	expected := rest.settings.Auth.OperatorToken
+	if expected == "" {
+		return isLoopback(request)
+	}
+
+	token := bearerToken(request)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// Rejects requests on the gin operator routes that aren't authorized
+func (rest *RestInterface) authenticateOperator(c *gin.Context) {
+	if !rest.operatorAuthorized(c.Request) {
+		log.Printf("[-] gin: unauthorized operator request for %s from %s\n", c.Request.URL.Path, c.Request.RemoteAddr)
+		c.JSON(http.StatusUnauthorized, "unauthorized")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// Wraps a plain operator route, rejecting the requests that aren't authorized
+func (rest *RestInterface) operatorOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !rest.operatorAuthorized(r) {
+			log.Printf("[-] unauthorized operator request for %s from %s\n", r.URL.Path, r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(request *http.Request) string {
+	parts := strings.SplitN(request.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+func isLoopback(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,93 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAgentTokens map[core.AgentID]string
+
+func (tokens fakeAgentTokens) IssueToken(id core.AgentID) (string, error) {
+	return tokens[id], nil
+}
+
+func (tokens fakeAgentTokens) RevokeToken(id core.AgentID) (bool, error) {
+	_, ok := tokens[id]
+	delete(tokens, id)
+	return ok, nil
+}
+
+func (tokens fakeAgentTokens) VerifyToken(id core.AgentID, token string) (bool, error) {
+	return tokens[id] != "" && tokens[id] == token, nil
+}
+
+func TestAuthenticateAgent(t *testing.T) {
+
+	rest := &RestInterface{agentTokens: fakeAgentTokens{{GID: 1, NID: 2}: "secret"}}
+
+	router := gin.New()
+	group := router.Group("/:gid/:nid")
+	group.Use(rest.authenticateAgent)
+	ok := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	group.GET("/cmd", ok)
+	group.GET("/hubble", ok)
+
+	request := func(path string, remote string, token string) int {
+		r, err := http.NewRequest("GET", path, nil)
+		assert.NoError(t, err)
+		r.RemoteAddr = remote
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("/1/2/cmd", "10.0.0.1:1234", "secret"))
+	assert.Equal(t, http.StatusUnauthorized, request("/1/2/cmd", "10.0.0.1:1234", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, request("/1/2/cmd", "10.0.0.1:1234", ""))
+	assert.Equal(t, http.StatusUnauthorized, request("/3/4/cmd", "10.0.0.1:1234", "secret"))
+
+	//only the builtin hubble agent goes without a token, and only on its route over loopback
+	assert.Equal(t, http.StatusOK, request("/0/0/hubble", "127.0.0.1:1234", ""))
+	assert.Equal(t, http.StatusUnauthorized, request("/0/0/cmd", "127.0.0.1:1234", ""))
+	assert.Equal(t, http.StatusUnauthorized, request("/0/0/hubble", "10.0.0.1:1234", ""))
+}
+
+func TestOperatorOnly(t *testing.T) {
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	request := func(rest *RestInterface, remote string, token string) int {
+		r, err := http.NewRequest("GET", "/metrics", nil)
+		assert.NoError(t, err)
+		r.RemoteAddr = remote
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		rest.operatorOnly(ok)(w, r)
+		return w.Code
+	}
+
+	//without an operator token, only loopback clients get through
+	open := &RestInterface{settings: &settings.Settings{}}
+	assert.Equal(t, http.StatusOK, request(open, "127.0.0.1:1234", ""))
+	assert.Equal(t, http.StatusOK, request(open, "[::1]:1234", ""))
+	assert.Equal(t, http.StatusUnauthorized, request(open, "10.0.0.1:1234", ""))
+	assert.Equal(t, http.StatusUnauthorized, request(open, "10.0.0.1:1234", "anything"))
+
+	//with one, the token is required from everywhere
+	closed := &RestInterface{settings: &settings.Settings{}}
+	closed.settings.Auth.OperatorToken = "operator"
+	assert.Equal(t, http.StatusOK, request(closed, "10.0.0.1:1234", "operator"))
+	assert.Equal(t, http.StatusUnauthorized, request(closed, "10.0.0.1:1234", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, request(closed, "127.0.0.1:1234", ""))
+}
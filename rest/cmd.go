@@ -35,6 +35,8 @@ func (rest *RestInterface) cmd(c *gin.Context) {
 		return
 	}
 	//at this point we are sure this is the ONLY agent polling on /gid/nid/cmd
+	longPolls.Inc()
+	defer longPolls.Dec()
 
 	var command core.Command
 
@@ -0,0 +1,66 @@
+package rest
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/amrhassan/agentcontroller2/enrollment"
+	"log"
+	"io/ioutil"
+	"net/http"
+	"encoding/json"
+)
+
+//EnrollRequest enrollment request
+type EnrollRequest struct {
+	Token string `json:"token"`
+	CSR   string `json:"csr"`
+}
+
+// Submits a CSR for approval along with a one-time enrollment token
+func (rest *RestInterface) enroll(c *gin.Context) {
+
+	content, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Println("[-] cannot read body:", err)
+		c.JSON(http.StatusInternalServerError, "body error")
+		return
+	}
+
+	var payload EnrollRequest
+	if err := json.Unmarshal(content, &payload); err != nil {
+		log.Println("[-] cannot read json:", err)
+		c.JSON(http.StatusBadRequest, "json error")
+		return
+	}
+
+	submitted, err := rest.enrollments.Submit(payload.Token, []byte(payload.CSR))
+	if err == enrollment.ErrInvalidToken {
+		log.Println("[-] gin: enrollment with an invalid token from", c.Request.RemoteAddr)
+		c.JSON(http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("[-] enrollment error:", err)
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("[+] gin: enrollment %s pending (gid: %d, nid: %d)\n", submitted.ID, submitted.Gid, submitted.Nid)
+
+	c.JSON(http.StatusAccepted, submitted)
+}
+
+// Gets the state of an enrollment, including the certificate once approved
+func (rest *RestInterface) enrollment(c *gin.Context) {
+
+	found, err := rest.enrollments.Get(c.Param("id"))
+	if err == enrollment.ErrNotFound {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("[-] enrollment error:", err)
+		c.JSON(http.StatusInternalServerError, "error")
+		return
+	}
+
+	c.JSON(http.StatusOK, found)
+}
@@ -61,9 +61,12 @@ func (rest *RestInterface) event(c *gin.Context) {
 	}
 
 	log.Println("Starting handler for", payload.Name, "event, for agent", id.GID, id.NID)
+	event := eventLabel(payload.Name)
+	eventHandlers.Inc(event)
 	err = cmd.Start()
 	if err != nil {
 		log.Println(err)
+		eventHandlerFailures.Inc(event)
 	} else {
 		go func() {
 			//wait for command to exit.
@@ -79,6 +82,7 @@ func (rest *RestInterface) event(c *gin.Context) {
 
 			err = cmd.Wait()
 			if err != nil {
+				eventHandlerFailures.Inc(event)
 				log.Println("Failed to handle ", payload.Name, " event for agent: ", id.GID, id.NID, err)
 				log.Println(string(cmdoutput))
 				log.Println(string(cmderrors))
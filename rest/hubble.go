@@ -0,0 +1,77 @@
+package rest
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/gin-gonic/gin"
+)
+
+// Sessions shorter than that are too easy to guess to stand for a connection
+const minHubbleSessionSize = 16
+
+/*
+Binds the sessions agents announce on their hubble connection, as in /gid/nid/hubble?session=xxx, to
+the identity of the verified client certificate of that very connection. The session is a secret the
+agent picks and repeats in its hubble key, so the key can be traced back to the connection it came
+through, and not just to any open connection of the agent it names.
+*/
+type HubbleSessions struct {
+	lock     sync.Mutex
+	sessions map[string]core.AgentID
+}
+
+func newHubbleSessions() *HubbleSessions {
+	return &HubbleSessions{sessions: make(map[string]core.AgentID)}
+}
+
+// Binds the session to the identity, returns false if another connection holds it already
+func (sessions *HubbleSessions) open(session string, id core.AgentID) bool {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	if _, taken := sessions.sessions[session]; taken {
+		return false
+	}
+	sessions.sessions[session] = id
+	return true
+}
+
+func (sessions *HubbleSessions) close(session string) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	delete(sessions.sessions, session)
+}
+
+// Returns the verified identity of the hubble connection that announced the session, while it is open
+func (sessions *HubbleSessions) Identity(session string) (core.AgentID, bool) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	id, ok := sessions.sessions[session]
+	return id, ok
+}
+
+// Serves a hubble connection, with the session it announced bound to its verified identity until it closes
+func (rest *RestInterface) serveHubbleSession(context *gin.Context, serve func()) {
+	session := context.Request.URL.Query().Get("session")
+
+	// verifyClientIdentity made sure a verified certificate belongs to the agent in the URL
+	state := context.Request.TLS
+	if session == "" || !rest.settings.ClientIdentity.Enabled() || state == nil || len(state.VerifiedChains) == 0 {
+		serve()
+		return
+	}
+
+	if len(session) < minHubbleSessionSize {
+		context.JSON(http.StatusBadRequest, "hubble session is too short")
+		return
+	}
+
+	if !rest.hubbleSessions.open(session, agentInformation(context)) {
+		context.JSON(http.StatusConflict, "hubble session is in use")
+		return
+	}
+	defer rest.hubbleSessions.close(session)
+
+	serve()
+}
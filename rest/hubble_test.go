@@ -0,0 +1,79 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHubbleSessions(t *testing.T) {
+
+	sessions := newHubbleSessions()
+	agent := core.AgentID{GID: 1, NID: 2}
+
+	_, ok := sessions.Identity("session")
+	assert.False(t, ok)
+
+	assert.True(t, sessions.open("session", agent))
+	assert.False(t, sessions.open("session", core.AgentID{GID: 1, NID: 3}))
+
+	id, ok := sessions.Identity("session")
+	assert.True(t, ok)
+	assert.Equal(t, agent, id)
+
+	sessions.close("session")
+	_, ok = sessions.Identity("session")
+	assert.False(t, ok)
+}
+
+func TestServeHubbleSessionBindsTheVerifiedIdentity(t *testing.T) {
+
+	rest := &RestInterface{settings: &settings.Settings{}, hubbleSessions: newHubbleSessions()}
+	rest.settings.ClientIdentity.Format = "%d-%d"
+
+	//the session is bound while the connection is served, to the agent its certificate was verified for
+	var served core.AgentID
+	var bound bool
+	router := gin.New()
+	router.GET("/:gid/:nid/hubble", func(c *gin.Context) {
+		rest.serveHubbleSession(c, func() {
+			served, bound = rest.hubbleSessions.Identity("0123456789abcdef")
+			c.String(http.StatusOK, "served")
+		})
+	})
+
+	request := func(url string, verified bool) int {
+		r, err := http.NewRequest("GET", url, nil)
+		assert.NoError(t, err)
+		r.TLS = &tls.ConnectionState{}
+		if verified {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{&x509.Certificate{}}}
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, r)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("/1/2/hubble?session=0123456789abcdef", true))
+	assert.True(t, bound)
+	assert.Equal(t, core.AgentID{GID: 1, NID: 2}, served)
+	_, open := rest.hubbleSessions.Identity("0123456789abcdef")
+	assert.False(t, open)
+
+	//without a verified certificate the session isn't bound to anything
+	assert.Equal(t, http.StatusOK, request("/1/2/hubble?session=0123456789abcdef", false))
+	assert.False(t, bound)
+
+	assert.Equal(t, http.StatusBadRequest, request("/1/2/hubble?session=short", true))
+
+	//a session is held by a single connection
+	rest.hubbleSessions.open("0123456789abcdef", core.AgentID{GID: 1, NID: 3})
+	assert.Equal(t, http.StatusConflict, request("/1/2/hubble?session=0123456789abcdef", true))
+}
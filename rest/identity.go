@@ -0,0 +1,79 @@
+package rest
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/settings"
+	"crypto/x509"
+	"net/http"
+	"log"
+	"context"
+)
+
+// Marks the requests that came through a listener with clientCA's
+type clientCertificateRequiredKey struct{}
+
+// The handler of all the routes for a listener, requests over a listener with clientCA's must carry a
+// verified client certificate of the Agent they are for
+func (rest *RestInterface) ListenerHandler(httpBinding settings.HTTPBinding) http.Handler {
+	if !httpBinding.ClientCertificateRequired() {
+		return rest.handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientCertificateRequiredKey{}, true)))
+	})
+}
+
+// Rejects requests on the Agent routes whose verified TLS client certificate doesn't belong to the
+// Agent in the URL, or that came without one through a listener with clientCA's. Requests without a
+// verified client certificate on listeners that don't require one are left for the other checks.
+func (rest *RestInterface) verifyClientIdentity(c *gin.Context) {
+
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		if required, _ := c.Request.Context().Value(clientCertificateRequiredKey{}).(bool); required {
+			log.Println("[-] gin: request without a verified client certificate on", c.Request.URL.Path)
+			c.JSON(http.StatusForbidden, "forbidden")
+			c.Abort()
+			return
+		}
+		c.Next()
+		return
+	}
+
+	id := agentInformation(c)
+	certificate := state.VerifiedChains[0][0]
+
+	for _, certificateID := range certificateIdentities(certificate, rest.settings.ClientIdentity) {
+		if certificateID == id {
+			c.Next()
+			return
+		}
+	}
+
+	log.Printf("[-] gin: client certificate %q is not valid for (gid: %d, nid: %d)\n",
+		certificate.Subject.CommonName, id.GID, id.NID)
+	c.JSON(http.StatusForbidden, "forbidden")
+	c.Abort()
+}
+
+// The Agent identities a certificate holds according to the configured identity mapping
+func certificateIdentities(certificate *x509.Certificate, identity settings.ClientIdentity) []core.AgentID {
+
+	var names []string
+	switch identity.Field {
+	case "CN":
+		names = []string{certificate.Subject.CommonName}
+	case "SAN":
+		names = certificate.DNSNames
+	}
+
+	var ids []core.AgentID
+	for _, name := range names {
+		if gid, nid, ok := identity.Parse(name); ok {
+			ids = append(ids, core.AgentID{GID: gid, NID: nid})
+		}
+	}
+
+	return ids
+}
@@ -0,0 +1,57 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyClientIdentity(t *testing.T) {
+
+	rest := &RestInterface{settings: &settings.Settings{}, handler: http.NewServeMux()}
+	rest.settings.ClientIdentity = settings.ClientIdentity{Field: "CN", Format: "%d-%d"}
+
+	router := gin.New()
+	router.GET("/:gid/:nid/cmd", rest.verifyClientIdentity, func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	rest.handler.Handle("/", router)
+
+	withClientCA := settings.HTTPBinding{ClientCA: make([]struct{ Cert string }, 1)}
+
+	request := func(binding settings.HTTPBinding, certificate *x509.Certificate) int {
+		r, err := http.NewRequest("GET", "/1/2/cmd", nil)
+		assert.NoError(t, err)
+		r.TLS = &tls.ConnectionState{}
+		if certificate != nil {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{certificate}}
+		}
+		recorder := httptest.NewRecorder()
+		rest.ListenerHandler(binding).ServeHTTP(recorder, r)
+		return recorder.Code
+	}
+
+	common := func(name string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	}
+
+	assert.Equal(t, http.StatusOK, request(withClientCA, common("1-2")))
+	assert.Equal(t, http.StatusForbidden, request(withClientCA, common("1-3")))
+	assert.Equal(t, http.StatusForbidden, request(withClientCA, nil))
+
+	//listeners without clientCA's leave requests without a certificate to the other checks
+	assert.Equal(t, http.StatusOK, request(settings.HTTPBinding{}, nil))
+	assert.Equal(t, http.StatusForbidden, request(settings.HTTPBinding{}, common("1-3")))
+
+	rest.settings.ClientIdentity.Field = "SAN"
+	assert.Equal(t, http.StatusOK, request(withClientCA, &x509.Certificate{DNSNames: []string{"2-1", "1-2"}}))
+	assert.Equal(t, http.StatusForbidden, request(withClientCA, &x509.Certificate{DNSNames: []string{"1-3"}}))
+	assert.Equal(t, http.StatusForbidden, request(withClientCA, common("1-2")))
+}
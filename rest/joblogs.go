@@ -0,0 +1,211 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/logs"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gin-gonic/gin"
+)
+
+// Parses a time given as unix seconds or RFC 3339
+func parseLogTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Builds a log filter from the level, since, until, gid and nid query parameters
+func logFilter(c *gin.Context) (*logs.Filter, error) {
+	query := c.Request.URL.Query()
+	filter := &logs.Filter{}
+
+	for _, levels := range query["level"] {
+		for _, level := range strings.Split(levels, ",") {
+			value, err := strconv.Atoi(level)
+			if err != nil {
+				return nil, fmt.Errorf("invalid level %q", level)
+			}
+			filter.Levels = append(filter.Levels, value)
+		}
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = parseLogTime(since); err != nil {
+			return nil, fmt.Errorf("invalid since %q", since)
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = parseLogTime(until); err != nil {
+			return nil, fmt.Errorf("invalid until %q", until)
+		}
+	}
+
+	for name, target := range map[string]**uint{"gid": &filter.Gid, "nid": &filter.Nid} {
+		if value := query.Get(name); value != "" {
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", name, value)
+			}
+			parsed := uint(id)
+			*target = &parsed
+		}
+	}
+
+	return filter, nil
+}
+
+// A job is known once it was dispatched, which queues its results, and until they expire
+func (rest *RestInterface) jobKnown(id string) (bool, error) {
+	db := rest.pool.Get()
+	defer db.Close()
+
+	return redis.Bool(db.Do("EXISTS", fmt.Sprintf(hashCmdResults, id)))
+}
+
+// Answers 404 and returns false if the job of the request isn't known
+func (rest *RestInterface) requireJob(c *gin.Context, id string) bool {
+	known, err := rest.jobKnown(id)
+	if err != nil {
+		log.Println("[-] cannot check job:", err)
+		c.JSON(http.StatusInternalServerError, "error")
+		return false
+	}
+	if !known {
+		c.JSON(http.StatusNotFound, "unknown job")
+		return false
+	}
+	return true
+}
+
+func (rest *RestInterface) jobLogs(c *gin.Context) {
+
+	id := c.Param("id")
+
+	filter, err := logFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := rest.logStore.Job(id, filter)
+	if err != nil {
+		log.Println("[-] cannot read job logs:", err)
+		c.JSON(http.StatusInternalServerError, "error")
+		return
+	}
+
+	if len(entries) == 0 && !rest.requireJob(c, id) {
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// Returns the results of a job, or of a single agent of it, once none of them is queued or running
+func (rest *RestInterface) jobFinished(id string, gid *uint, nid *uint) ([]*core.CommandResult, bool) {
+	db := rest.pool.Get()
+	defer db.Close()
+
+	dumps, err := redis.StringMap(db.Do("HGETALL", fmt.Sprintf(hashCmdResults, id)))
+	if err != nil {
+		log.Println("[-] cannot read job results:", err)
+		return nil, false
+	}
+
+	var results []*core.CommandResult
+	for _, dump := range dumps {
+		result := &core.CommandResult{}
+		if err := json.Unmarshal([]byte(dump), result); err != nil {
+			continue
+		}
+		if (gid != nil && uint(result.Gid) != *gid) || (nid != nil && uint(result.Nid) != *nid) {
+			continue
+		}
+		if result.State == core.COMMAND_STATE_QUEUED || result.State == core.COMMAND_STATE_RUNNING {
+			return nil, false
+		}
+		results = append(results, result)
+	}
+
+	//nothing was dispatched yet
+	if len(results) == 0 {
+		return nil, false
+	}
+
+	return results, true
+}
+
+// Writes a server-sent event
+func writeEvent(w io.Writer, event string, data interface{}) error {
+	dump, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, dump)
+	return err
+}
+
+/*
+Streams the logs of a job as server-sent events: a log event per entry, those already stored
+first, then an end event with the results once the job is finished on all the agents, or on the
+one selected with gid and nid.
+*/
+func (rest *RestInterface) followJobLogs(c *gin.Context) {
+
+	id := c.Param("id")
+
+	filter, err := logFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !rest.requireJob(c, id) {
+		return
+	}
+
+	// listen for http closing
+	notify := c.Writer.(http.CloseNotifier).CloseNotify()
+	flusher := c.Writer.(http.Flusher)
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var results []*core.CommandResult
+	finished := func() bool {
+		var done bool
+		results, done = rest.jobFinished(id, filter.Gid, filter.Nid)
+		return done
+	}
+
+	send := func(entry *logs.Entry) error {
+		if err := writeEvent(c.Writer, "log", entry); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if err := rest.logStore.Follow(id, filter, notify, finished, send); err != nil {
+		log.Println("[-] stopped following job logs:", err)
+		return
+	}
+
+	if results != nil {
+		writeEvent(c.Writer, "end", results)
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,124 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/logs"
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func jobLogsRouter(t *testing.T) *gin.Engine {
+	var dumps []interface{}
+	for i, level := range []int{1, 2, 1, 3} {
+		dump, err := json.Marshal(&logs.Entry{JobID: "job", Gid: 1, Nid: uint(2 + i%2), Level: level,
+			Epoch: int64(1445000000+i) * 1000, Message: fmt.Sprint("message ", i)})
+		assert.NoError(t, err)
+		dumps = append(dumps, dump)
+	}
+
+	recording := &recordingRedis{replies: map[string]interface{}{
+		"LRANGE joblogs:job 0 -1":     dumps,
+		"LRANGE joblogs:silent 0 -1":  []interface{}{},
+		"LRANGE joblogs:unknown 0 -1": []interface{}{},
+		"EXISTS jobresult:job":        int64(1),
+		"EXISTS jobresult:silent":     int64(1),
+		"EXISTS jobresult:unknown":    int64(0),
+	}}
+	rest := &RestInterface{
+		pool:     recording.pool(),
+		settings: &settings.Settings{},
+		logStore: logs.NewStore(recording.pool(), logs.StoreOptions{}),
+	}
+	rest.settings.Auth.OperatorToken = "operator"
+
+	router := gin.New()
+	router.GET("/jobs/:id/logs", rest.authenticateOperator, rest.jobLogs)
+	router.GET("/jobs/:id/logs/follow", rest.authenticateOperator, rest.followJobLogs)
+	return router
+}
+
+// Gets the logs of a job, returning the status and the messages
+func getJobLogs(t *testing.T, router *gin.Engine, path string, token string) (int, []string) {
+	r, err := http.NewRequest("GET", path, nil)
+	assert.NoError(t, err)
+	r.RemoteAddr = "10.0.0.1:1234"
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	var messages []string
+	if w.Code == http.StatusOK {
+		var entries []*logs.Entry
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		for _, entry := range entries {
+			messages = append(messages, entry.Message)
+		}
+	}
+	return w.Code, messages
+}
+
+func TestJobLogsFilters(t *testing.T) {
+
+	router := jobLogsRouter(t)
+
+	code, messages := getJobLogs(t, router, "/jobs/job/logs", "operator")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"message 0", "message 1", "message 2", "message 3"}, messages)
+
+	_, messages = getJobLogs(t, router, "/jobs/job/logs?level=1", "operator")
+	assert.Equal(t, []string{"message 0", "message 2"}, messages)
+
+	_, messages = getJobLogs(t, router, "/jobs/job/logs?level=2,3", "operator")
+	assert.Equal(t, []string{"message 1", "message 3"}, messages)
+
+	_, messages = getJobLogs(t, router, "/jobs/job/logs?level=1&level=3", "operator")
+	assert.Equal(t, []string{"message 0", "message 2", "message 3"}, messages)
+
+	_, messages = getJobLogs(t, router, "/jobs/job/logs?since=1445000001&until=1445000002", "operator")
+	assert.Equal(t, []string{"message 1", "message 2"}, messages)
+
+	_, messages = getJobLogs(t, router, "/jobs/job/logs?since=2015-10-16T12:53:22Z", "operator")
+	assert.Equal(t, []string{"message 2", "message 3"}, messages)
+
+	_, messages = getJobLogs(t, router, "/jobs/job/logs?nid=3&level=3", "operator")
+	assert.Equal(t, []string{"message 3"}, messages)
+
+	code, _ = getJobLogs(t, router, "/jobs/job/logs?level=high", "operator")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = getJobLogs(t, router, "/jobs/job/logs?since=yesterday", "operator")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestJobLogsUnknownJob(t *testing.T) {
+
+	router := jobLogsRouter(t)
+
+	code, messages := getJobLogs(t, router, "/jobs/silent/logs", "operator")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, messages)
+
+	code, _ = getJobLogs(t, router, "/jobs/unknown/logs", "operator")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = getJobLogs(t, router, "/jobs/unknown/logs/follow", "operator")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestJobLogsNeedTheOperatorToken(t *testing.T) {
+
+	router := jobLogsRouter(t)
+
+	code, _ := getJobLogs(t, router, "/jobs/job/logs", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = getJobLogs(t, router, "/jobs/job/logs", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = getJobLogs(t, router, "/jobs/job/logs/follow", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
@@ -0,0 +1,37 @@
+package rest
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"io/ioutil"
+	"net/http"
+	"github.com/amrhassan/agentcontroller2/seal"
+)
+
+// Registers the PEM-encoded public key that commands marked as encrypted get sealed to for this Agent
+func (rest *RestInterface) key(c *gin.Context) {
+
+	id := agentInformation(c)
+
+	log.Printf("[+] gin: key (gid: %d, nid: %d)\n", id.GID, id.NID)
+
+	content, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		log.Println("[-] cannot read body:", err)
+		c.JSON(http.StatusInternalServerError, "body error")
+		return
+	}
+
+	if _, err := seal.ParsePublicKey(content); err != nil {
+		log.Println("[-] invalid public key:", err)
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := rest.agentKeys.SetPublicKey(id, content); err != nil {
+		log.Println("[-] cannot store public key:", err)
+		c.JSON(http.StatusInternalServerError, "error")
+		return
+	}
+
+	c.JSON(http.StatusOK, "ok")
+}
@@ -4,17 +4,49 @@ import (
 	"log"
 	"io/ioutil"
 	"net/http"
-	"fmt"
+	"time"
+	"github.com/amrhassan/agentcontroller2/logs"
+	"github.com/amrhassan/agentcontroller2/settings"
 )
 
+// Creates the log sinks configured in the settings, nil if there are none
+func newLogSink(settings *settings.Settings) (logs.Sink, error) {
+	if len(settings.Logs.Sink) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(settings.Logs.Sink))
+	sinks := make([]logs.Sink, 0, len(settings.Logs.Sink))
+	for _, config := range settings.Logs.Sink {
+		var sink logs.Sink
+		var err error
+
+		switch config.Type {
+		case logs.SinkFile:
+			sink, err = logs.NewFileSink(config.Path, int64(config.MaxSize) * 1024 * 1024, config.MaxBackups)
+		case logs.SinkSyslog:
+			sink, err = logs.NewSyslogSink(config.Network, config.Address, config.Tag)
+		case logs.SinkWebhook:
+			sink = logs.NewWebhookSink(config.URL, config.Headers, time.Duration(config.Timeout) * time.Second)
+		default:
+			err = logs.UnknownSinkError(config.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, config.Type)
+		sinks = append(sinks, &logs.LevelSink{Sink: sink, Levels: config.Levels})
+	}
+
+	return logs.NewFanout(names, sinks), nil
+}
+
 func (rest *RestInterface) logs(c *gin.Context) {
 
 	agentID := agentInformation(c)
 
-	db := rest.pool.Get()
-	defer db.Close()
-
-	log.Printf("[+] gin: log (gid: %s, nid: %s)\n", agentID.GID, agentID.NID)
+	log.Printf("[+] gin: log (gid: %d, nid: %d)\n", agentID.GID, agentID.NID)
 
 	// read body
 	content, err := ioutil.ReadAll(c.Request.Body)
@@ -25,12 +57,24 @@ func (rest *RestInterface) logs(c *gin.Context) {
 		return
 	}
 
-	// push body to redis
-	id := fmt.Sprintf("%s:%s:log", agentID.GID, agentID.NID)
-	log.Printf("[+] message destination [%s]\n", id)
+	entries, err := logs.Parse(content, agentID.GID, agentID.NID, time.Now())
+	if err != nil {
+		log.Println("[-] cannot read log:", err)
+		c.JSON(http.StatusBadRequest, "log format error")
+		return
+	}
+
+	// store the entries per job and per agent
+	if err := rest.logStore.Push(entries); err != nil {
+		log.Println("[-] cannot store log:", err)
+		c.JSON(http.StatusInternalServerError, "error")
+		return
+	}
 
-	// push message to client queue
-	_, err = db.Do("RPUSH", id, content)
+	// forward them to the configured sinks, in the background
+	if rest.logSink != nil {
+		rest.logSink.Write(entries)
+	}
 
 	c.JSON(http.StatusOK, "ok")
-}
\ No newline at end of file
+}
@@ -0,0 +1,58 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/amrhassan/agentcontroller2/metrics"
+	"github.com/amrhassan/agentcontroller2/stats"
+)
+
+var (
+	longPolls = metrics.NewGauge("agentcontroller_long_polls",
+		"Agents currently waiting on GET /:gid/:nid/cmd for a command.")
+	eventHandlers = metrics.NewCounter("agentcontroller_event_handlers_total",
+		"Executions of the event handlers, by event.", "event")
+	eventHandlerFailures = metrics.NewCounter("agentcontroller_event_handler_failures_total",
+		"Event handlers that failed to start or exited with an error, by event.", "event")
+)
+
+// The events agents send, any other name is counted as "other" to keep the event label bounded
+var knownEvents = map[string]bool{
+	"startup": true,
+}
+
+func eventLabel(name string) string {
+	if knownEvents[name] {
+		return name
+	}
+	return "other"
+}
+
+// Reports the points that went through the background stats writer
+func installStatsMetrics(buffered *stats.BufferedSink) {
+	collect := func(count func(stats.BufferCounters) uint64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(count(buffered.Counters()))}}
+		}
+	}
+
+	metrics.NewCounterFunc("agentcontroller_stats_points_written_total", "Stats points written to the sink.", nil,
+		collect(func(counters stats.BufferCounters) uint64 { return counters.Written }))
+	metrics.NewCounterFunc("agentcontroller_stats_points_spooled_total", "Stats points spooled while the sink was unavailable.", nil,
+		collect(func(counters stats.BufferCounters) uint64 { return counters.Spooled }))
+	metrics.NewCounterFunc("agentcontroller_stats_points_dropped_total", "Stats points dropped because the buffer or the spool was full.", nil,
+		collect(func(counters stats.BufferCounters) uint64 { return counters.Dropped }))
+	metrics.NewCounterFunc("agentcontroller_stats_points_rejected_total", "Stats points the sink refused, they are not retried.", nil,
+		collect(func(counters stats.BufferCounters) uint64 { return counters.Rejected }))
+}
+
+// Serves the controller metrics, followed by the agent stats when they go to the prometheus sink
+func (rest *RestInterface) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metrics.Default.Expose(w)
+
+	if prometheus, ok := rest.statsBackend.(*stats.PrometheusSink); ok {
+		prometheus.Expose(w)
+	}
+}
@@ -0,0 +1,76 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// recordingRedis records the commands it gets, replying from replies by command line, or nil
+type recordingRedis struct {
+	lock     sync.Mutex
+	commands []string
+	replies  map[string]interface{}
+}
+
+func (recording *recordingRedis) pool() *redis.Pool {
+	return &redis.Pool{Dial: func() (redis.Conn, error) {
+		return &recordingConn{redis: recording}, nil
+	}}
+}
+
+// Returns the recorded commands, each one as its name and arguments separated by spaces
+func (recording *recordingRedis) recorded() []string {
+	recording.lock.Lock()
+	defer recording.lock.Unlock()
+	return append([]string(nil), recording.commands...)
+}
+
+type recordingConn struct {
+	redis *recordingRedis
+}
+
+func (conn *recordingConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command == "" {
+		return nil, nil
+	}
+
+	line := command
+	for _, arg := range args {
+		line += " " + redisArg(arg)
+	}
+
+	conn.redis.lock.Lock()
+	defer conn.redis.lock.Unlock()
+	conn.redis.commands = append(conn.redis.commands, line)
+	return conn.redis.replies[line], nil
+}
+
+func (conn *recordingConn) Send(command string, args ...interface{}) error {
+	return errors.New("recording redis doesn't pipeline")
+}
+
+func (conn *recordingConn) Flush() error {
+	return nil
+}
+
+func (conn *recordingConn) Receive() (interface{}, error) {
+	return nil, errors.New("recording redis doesn't pipeline")
+}
+
+func (conn *recordingConn) Close() error {
+	return nil
+}
+
+func (conn *recordingConn) Err() error {
+	return nil
+}
+
+func redisArg(arg interface{}) string {
+	if bytes, ok := arg.([]byte); ok {
+		return string(bytes)
+	}
+	return fmt.Sprint(arg)
+}
@@ -8,38 +8,131 @@ import (
 	"fmt"
 	hublleProxy "github.com/Jumpscale/hubble/proxy"
 	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/amrhassan/agentcontroller2/redisdata"
+	"github.com/amrhassan/agentcontroller2/enrollment"
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/amrhassan/agentcontroller2/logs"
+	"github.com/amrhassan/agentcontroller2/retention"
+	"time"
+	"net/http"
+	"log"
 )
 
 const (
 	hashCmdResults            = "jobresult:%s"
 	cmdQueueAgentResponse     = "cmd.%s.%d.%d"
+	cmdQueueMain              = "cmds.queue"
 )
 
-var influxDbTags = []string{"gid", "nid", "command", "domain", "name", "measurement"}
-
 type RestInterface struct {
 	pool *redis.Pool
 	pollDataStreamManager *agentpoll.PollDataStreamManager
 	router 		*gin.Engine
+	controllerRouter *gin.Engine
+	handler		*http.ServeMux
 	settings 	*settings.Settings
+	agentKeys	core.AgentKeyStorage
+	agentTokens	core.AgentTokenStorage
+	enrollments	*enrollment.Store
+	statsSink	stats.Sink
+	statsBackend	stats.Sink
+	logStore	*logs.Store
+	logSink	logs.Sink
+	keeper	*retention.Keeper
+	hubbleSessions	*HubbleSessions
 }
 
+// The router of the per-Agent /:gid/:nid routes
 func (rest *RestInterface) Router() *gin.Engine {
 	return rest.router
 }
 
+// Applies the retention to the jobs as they finish
+func (rest *RestInterface) Keeper() *retention.Keeper {
+	return rest.keeper
+}
+
+// The sessions announced by the hubble connections with a verified client certificate
+func (rest *RestInterface) HubbleSessions() *HubbleSessions {
+	return rest.hubbleSessions
+}
+
+// The handler of all the routes, the per-Agent ones and those that don't belong to an Agent
+func (rest *RestInterface) Handler() http.Handler {
+	return rest.handler
+}
+
 func NewRestInterface(pool *redis.Pool, pollDataStreamManager *agentpoll.PollDataStreamManager,
 	settings *settings.Settings) *RestInterface {
 
+	redisData := redisdata.NewRedisData(pool)
+
 	rest := &RestInterface{
 		pool: pool,
 		pollDataStreamManager: pollDataStreamManager,
 		router: gin.Default(),
+		controllerRouter: gin.Default(),
+		handler: http.NewServeMux(),
 		settings: settings,
+		agentKeys: redisData,
+		agentTokens: redisData,
+		enrollments: enrollment.NewStore(pool),
+		logStore: logs.NewStore(pool, logs.StoreOptions{
+			JobSize: settings.Logs.JobSize,
+			AgentSize: settings.Logs.AgentSize,
+			Retention: time.Duration(settings.Logs.Retention) * time.Hour,
+		}),
+		hubbleSessions: newHubbleSessions(),
+		keeper: retention.NewKeeper(pool, retention.Options{
+			TTL: time.Duration(settings.Retention.Results) * time.Hour,
+			JoblogSize: settings.Retention.Joblog,
+			ArchiveDir: settings.Retention.Archive,
+		}),
+	}
+
+	// The routes that don't belong to an Agent can't live next to the /:gid/:nid wildcards
+	rest.handler.Handle("/", rest.router)
+
+	statsSink, statsBackend, err := rest.newStatsSink(pool, settings)
+	if err != nil {
+		log.Panicln("Unable to create the stats sink", err)
+	}
+	rest.statsSink = statsSink
+	rest.statsBackend = statsBackend
+
+	if buffered, ok := statsBackend.(*stats.BufferedSink); ok {
+		installStatsMetrics(buffered)
+	}
+
+	rest.handler.HandleFunc("/metrics", rest.operatorOnly(rest.metrics))
+
+	logSink, err := newLogSink(settings)
+	if err != nil {
+		log.Panicln("Unable to create the log sinks", err)
+	}
+	rest.logSink = logSink
+
+	rest.controllerRouter.GET("/jobs/:id/logs", rest.authenticateOperator, rest.jobLogs)
+	rest.controllerRouter.GET("/jobs/:id/logs/follow", rest.authenticateOperator, rest.followJobLogs)
+	rest.handler.Handle("/jobs/", rest.controllerRouter)
+
+	if settings.EnrollmentEnabled() {
+		rest.controllerRouter.POST("/enroll", rest.enroll)
+		rest.controllerRouter.GET("/enroll/:id", rest.enrollment)
+		rest.handler.Handle("/enroll", rest.controllerRouter)
+		rest.handler.Handle("/enroll/", rest.controllerRouter)
 	}
 
 	agentGroup := rest.router.Group("/:gid/:nid")
 
+	if settings.ClientIdentity.Enabled() {
+		agentGroup.Use(rest.verifyClientIdentity)
+	}
+
+	if settings.Auth.AgentTokens {
+		agentGroup.Use(rest.authenticateAgent)
+	}
+
 	agentGroup.GET("/cmd", rest.cmd)
 	agentGroup.POST("/log", rest.logs)
 	agentGroup.POST("/result", rest.result)
@@ -47,16 +140,11 @@ func NewRestInterface(pool *redis.Pool, pollDataStreamManager *agentpoll.PollDat
 	agentGroup.POST("/event", rest.event)
 	agentGroup.GET("/hubble", rest.handlHubbleProxy)
 	agentGroup.GET("/script", rest.script)
+	agentGroup.POST("/key", rest.key)
 
 	return rest
 }
 
-//StatsRequest stats request
-type StatsRequest struct {
-	Timestamp int64           `json:"timestamp"`
-	Series    [][]interface{} `json:"series"`
-}
-
 //EvenRequest event request
 type EvenRequest struct {
 	Name string `json:"name"`
@@ -97,6 +185,8 @@ func getAgentResultQueue(result *core.CommandResult) string {
 }
 
 func (rest *RestInterface) handlHubbleProxy(context *gin.Context) {
-	hublleProxy.ProxyHandler(context.Writer, context.Request)
+	rest.serveHubbleSession(context, func() {
+		hublleProxy.ProxyHandler(context.Writer, context.Request)
+	})
 }
 
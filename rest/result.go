@@ -14,11 +14,11 @@ func (rest *RestInterface) result(c *gin.Context) {
 
 	id := agentInformation(c)
 
-	key := fmt.Sprintf("%s:%s", id.GID, id.NID)
+	key := fmt.Sprintf("%d:%d", id.GID, id.NID)
 	db := rest.pool.Get()
 	defer db.Close()
 
-	log.Printf("[+] gin: result (gid: %s, nid: %s)\n", id.GID, id.NID)
+	log.Printf("[+] gin: result (gid: %d, nid: %d)\n", id.GID, id.NID)
 
 	// read body
 	content, err := ioutil.ReadAll(c.Request.Body)
@@ -50,6 +50,16 @@ func (rest *RestInterface) result(c *gin.Context) {
 	// push message to client main result queue
 	db.Do("RPUSH", getAgentResultQueue(&payload), content)
 
+	// the job may be finished
+	if err := rest.keeper.Finished(payload.ID); err != nil {
+		log.Println("[-] cannot apply job retention:", err)
+	}
+
+	// wake up the followers of the job logs, it may be finished
+	if err := rest.logStore.Signal(payload.ID); err != nil {
+		log.Println("[-] cannot signal job logs followers:", err)
+	}
+
 	c.JSON(http.StatusOK, "ok")
 }
 
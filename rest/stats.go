@@ -4,19 +4,119 @@ import (
 	"log"
 	"io/ioutil"
 	"net/http"
-	"encoding/json"
 	"fmt"
-	"net/url"
-	"time"
 	"strings"
-	influxdb "github.com/influxdb/influxdb/client"
+	"time"
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/amrhassan/agentcontroller2/alerts"
+	"github.com/garyburd/redigo/redis"
 )
 
+// Creates the stats sink selected in the settings, behind the alerts and rollups if there are rules for them.
+// The sink the points go through first is returned along with the one they end up in.
+func (rest *RestInterface) newStatsSink(pool *redis.Pool, settings *settings.Settings) (stats.Sink, stats.Sink, error) {
+	backend, err := newStatsBackend(pool, settings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sink, err := newStatsRollup(backend, settings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(settings.Alert) == 0 {
+		return sink, backend, nil
+	}
+
+	rules := make([]alerts.Rule, 0, len(settings.Alert))
+	for _, rule := range settings.Alert {
+		rules = append(rules, alerts.Rule{
+			Name:        rule.Name,
+			Measurement: rule.Measurement,
+			Field:       rule.Field,
+			Op:          rule.Op,
+			Threshold:   rule.Threshold,
+			For:         time.Duration(rule.For) * time.Second,
+			Remediation: rule.Remediation,
+		})
+	}
+
+	evaluator, err := alerts.NewEvaluator(sink, rules, rest.alert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return evaluator, backend, nil
+}
+
+func newStatsRollup(sink stats.Sink, settings *settings.Settings) (stats.Sink, error) {
+	if len(settings.Stats.Rollup) == 0 {
+		return sink, nil
+	}
+
+	rules := make([]stats.RollupRule, 0, len(settings.Stats.Rollup))
+	for _, rule := range settings.Stats.Rollup {
+		rules = append(rules, stats.RollupRule{
+			Measurement: rule.Measurement,
+			Forward:     rule.Forward,
+			Window:      time.Duration(rule.Window) * time.Second,
+		})
+	}
+
+	return stats.NewRollup(sink, rules)
+}
+
+func newStatsBackend(pool *redis.Pool, settings *settings.Settings) (stats.Sink, error) {
+	switch settings.Stats.Sink {
+	case "", stats.SinkInfluxDB:
+		influx, err := stats.NewInfluxDBSink(settings.Influxdb.Host, settings.Influxdb.Db,
+			settings.Influxdb.User, settings.Influxdb.Password)
+		if err != nil {
+			return nil, err
+		}
+		return stats.NewBufferedSink(influx, pool, stats.BufferOptions{
+			BatchSize:     settings.Stats.BatchSize,
+			FlushInterval: time.Duration(settings.Stats.FlushInterval) * time.Second,
+			Retries:       stats.DefaultRetries,
+			SpoolSize:     settings.Stats.SpoolSize,
+		}), nil
+	case stats.SinkPrometheus:
+		return stats.NewPrometheusSink(stats.PrometheusOptions{
+			StaleAfter: time.Duration(settings.Stats.StaleAfter) * time.Second,
+			MaxSeries:  settings.Stats.MaxSeries,
+		}), nil
+	default:
+		return nil, stats.UnknownSinkError(settings.Stats.Sink)
+	}
+}
+
+// The response to a stats payload with invalid points, the valid ones are still written
+type statsRejection struct {
+	Accepted int              `json:"accepted"`
+	Rejected []stats.Rejected `json:"rejected"`
+}
+
+var statsPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+/*
+Stats are either a JSON array of legacy series batches and points with explicit tags and fields,
+or InfluxDB line protocol when sent as text/plain, with timestamps in the precision query
+parameter (ns, u, ms or s). Points are always tagged with the gid and nid of the agent, an agent
+can't report stats on behalf of another one.
+*/
 func (rest *RestInterface) stats(c *gin.Context) {
 
 	id := agentInformation(c)
 
-	log.Printf("[+] gin: stats (gid: %s, nid: %s)\n", id.GID, id.NID)
+	log.Printf("[+] gin: stats (gid: %d, nid: %d)\n", id.GID, id.NID)
 
 	// read body
 	content, err := ioutil.ReadAll(c.Request.Body)
@@ -27,81 +127,45 @@ func (rest *RestInterface) stats(c *gin.Context) {
 		return
 	}
 
-	// decode body
-	var payload []StatsRequest
-	err = json.Unmarshal(content, &payload)
-
-	if err != nil {
-		log.Println("[-] cannot read json:", err)
-		c.JSON(http.StatusInternalServerError, "json error")
-		return
-	}
+	var points []stats.Point
+	var rejected []stats.Rejected
+	now := time.Now()
 
-	u, err := url.Parse(fmt.Sprintf("http://%s", rest.settings.Influxdb.Host))
-	if err != nil {
-		log.Println(err)
-		return
+	if strings.HasPrefix(c.Request.Header.Get("Content-Type"), "text/plain") {
+		precision, ok := statsPrecisions[c.Request.URL.Query().Get("precision")]
+		if !ok {
+			c.JSON(http.StatusBadRequest, "unknown precision, expected ns, u, ms or s")
+			return
+		}
+		points, rejected = stats.ParseLineProtocol(content, precision, now)
+	} else {
+		points, rejected, err = stats.ParseJSON(content, now)
+		if err != nil {
+			log.Println("[-] cannot read json:", err)
+			c.JSON(http.StatusBadRequest, "json error")
+			return
+		}
 	}
 
-	// building Influxdb requests
-	con, err := influxdb.NewClient(influxdb.Config{
-		Username: rest.settings.Influxdb.User,
-		Password: rest.settings.Influxdb.Password,
-		URL:      *u,
-	})
-
-	if err != nil {
-		log.Println(err)
+	for i := range points {
+		points[i].Tags["gid"] = fmt.Sprint(id.GID)
+		points[i].Tags["nid"] = fmt.Sprint(id.NID)
+		points[i].Agent = &id
 	}
 
-	points := make([]influxdb.Point, 0, 100)
-
-	for _, stats := range payload {
-		for i := 0; i < len(stats.Series); i++ {
-			var value float64
-			switch v := stats.Series[i][1].(type) {
-			case int:
-				value = float64(v)
-			case float32:
-				value = float64(v)
-			case float64:
-				value = v
-			default:
-				log.Println("Invalid influxdb value:", v)
-			}
-
-			key := stats.Series[i][0].(string)
-			//key is formated as gid.nid.cmd.domain.name.[measuerment] (6 parts)
-			//so we can split it and then fill the gags.
-			tags := make(map[string]string)
-			tagsValues := strings.SplitN(key, ".", 6)
-			for i, tagValue := range tagsValues {
-				tags[influxDbTags[i]] = tagValue
-			}
-
-			point := influxdb.Point{
-				Measurement: key,
-				Time:        time.Unix(stats.Timestamp, 0),
-				Tags:        tags,
-				Fields: map[string]interface{}{
-					"value": value,
-				},
-			}
-
-			points = append(points, point)
+	if len(points) > 0 {
+		if err := rest.statsSink.Write(points); err != nil {
+			log.Println("STATS SINK ERROR:", err)
+			c.JSON(http.StatusInternalServerError, "stats sink error")
+			return
 		}
 	}
 
-	batchPoints := influxdb.BatchPoints{
-		Points:          points,
-		Database:        rest.settings.Influxdb.Db,
-		RetentionPolicy: "default",
-	}
-
-	if _, err := con.Write(batchPoints); err != nil {
-		log.Println("INFLUXDB ERROR:", err)
+	if len(rejected) > 0 {
+		log.Println("[-] rejected", len(rejected), "stats points from", id)
+		c.JSON(http.StatusBadRequest, &statsRejection{Accepted: len(points), Rejected: rejected})
 		return
 	}
 
 	c.JSON(http.StatusOK, "ok")
-}
\ No newline at end of file
+}
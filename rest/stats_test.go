@@ -0,0 +1,50 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSink struct {
+	points []stats.Point
+}
+
+func (sink *recordingSink) Write(points []stats.Point) error {
+	sink.points = append(sink.points, points...)
+	return nil
+}
+
+func TestStatsAreTaggedWithTheAgent(t *testing.T) {
+
+	sink := &recordingSink{}
+	rest := &RestInterface{statsSink: sink}
+
+	router := gin.New()
+	router.POST("/:gid/:nid/stats", rest.stats)
+
+	post := func(contentType string, body string) int {
+		r, err := http.NewRequest("POST", "/1/2/stats", strings.NewReader(body))
+		assert.NoError(t, err)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("text/plain", "cpu,gid=3,nid=4,core=0 value=1\nmem value=2"))
+	assert.Equal(t, http.StatusOK, post("application/json", `[{"timestamp": 1445000000, "series": [["3.4.cmd.domain.name.load", 0.5]]}]`))
+
+	if assert.Len(t, sink.points, 3) {
+		for _, point := range sink.points {
+			assert.Equal(t, "1", point.Tags["gid"], point.Measurement)
+			assert.Equal(t, "2", point.Tags["nid"], point.Measurement)
+		}
+		assert.Equal(t, "0", sink.points[0].Tags["core"])
+	}
+}
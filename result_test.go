@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/redisdata"
+	"github.com/amrhassan/agentcontroller2/rest"
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRestInterface(fake *fakeRedis) *rest.RestInterface {
+	s := &settings.Settings{}
+	s.Stats.Sink = "prometheus"
+	s.Retention.Results = 1
+	s.Retention.Joblog = 10
+	return rest.NewRestInterface(fake.pool(), nil, s)
+}
+
+//dispatch queues the placeholder result of the command for the agent, as the dispatch loop does
+func dispatch(t *testing.T, fake *fakeRedis, id string, agent core.AgentID) {
+	err := redisdata.NewRedisData(fake.pool()).RespondToCommandAsJustQueued(agent, &core.Command{ID: id})
+	assert.NoError(t, err)
+}
+
+//postResult posts the result of the command as the agent does
+func postResult(t *testing.T, handler http.Handler, id string, agent core.AgentID, state string) {
+	dump, err := json.Marshal(&core.CommandResult{ID: id, Gid: int(agent.GID), Nid: int(agent.NID), State: state})
+	assert.NoError(t, err)
+
+	request, err := http.NewRequest("POST", fmt.Sprintf("/%d/%d/result", agent.GID, agent.NID), bytes.NewReader(dump))
+	assert.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestResultFinishesTheJob(t *testing.T) {
+
+	fake := newFakeRedis()
+	restInterface := newTestRestInterface(fake)
+	agent := core.AgentID{GID: 1, NID: 2}
+
+	dispatch(t, fake, "job", agent)
+	assert.NoError(t, restInterface.Keeper().Finished("job"))
+	assert.Empty(t, fake.zsets["jobs.finished"])
+
+	postResult(t, restInterface.Handler(), "job", agent, "SUCCESS")
+
+	//the result replaces the placeholder of the dispatch
+	results := fake.hashes["jobresult:job"]
+	assert.Len(t, results, 1)
+	var result core.CommandResult
+	assert.NoError(t, json.Unmarshal([]byte(results["1:2"]), &result))
+	assert.Equal(t, "SUCCESS", result.State)
+
+	_, finished := fake.zsets["jobs.finished"]["job"]
+	assert.True(t, finished)
+}
+
+//nextEvent reads the stream up to the next server-sent event and returns its name
+func nextEvent(t *testing.T, reader *bufio.Reader) string {
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		if strings.HasPrefix(line, "event: ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "event: "))
+		}
+	}
+}
+
+func TestFollowEndsOnceTheResultIsPosted(t *testing.T) {
+
+	fake := newFakeRedis()
+	restInterface := newTestRestInterface(fake)
+	server := httptest.NewServer(restInterface.Handler())
+	defer server.Close()
+
+	agent := core.AgentID{GID: 1, NID: 2}
+	dispatch(t, fake, "job", agent)
+
+	response, err := http.Get(server.URL + "/jobs/job/logs/follow")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	reader := bufio.NewReader(response.Body)
+
+	request, err := http.NewRequest("POST", "/1/2/log", strings.NewReader(`{"id": "job", "level": 1, "data": "working"}`))
+	assert.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	restInterface.Handler().ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "log", nextEvent(t, reader))
+
+	postResult(t, restInterface.Handler(), "job", agent, "SUCCESS")
+	assert.Equal(t, "end", nextEvent(t, reader))
+
+	//a job that finished already ends right after its stored logs
+	finished, err := http.Get(server.URL + "/jobs/job/logs/follow")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer finished.Body.Close()
+	reader = bufio.NewReader(finished.Body)
+	assert.Equal(t, "log", nextEvent(t, reader))
+	assert.Equal(t, "end", nextEvent(t, reader))
+}
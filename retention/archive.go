@@ -0,0 +1,183 @@
+package retention
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// Jobs are archived that long after they finish, the agents of a fanout may still be getting theirs
+	ArchiveGrace = time.Minute
+
+	archiveInterval  = time.Minute
+	archiveBatchSize = 500
+)
+
+// A finished job as written to the archive
+type Record struct {
+	ID string `json:"id"`
+	// Finished is the unix time the job finished at
+	Finished int64                 `json:"finished"`
+	Results  []*core.CommandResult `json:"results"`
+	Logs     []json.RawMessage     `json:"logs"`
+}
+
+// Archives the finished jobs every minute, a job is archived by the first controller that claims it
+func (keeper *Keeper) RunArchiver() {
+	if keeper.options.ArchiveDir == "" {
+		return
+	}
+
+	for now := range time.Tick(archiveInterval) {
+		if _, err := keeper.Archive(now); err != nil {
+			log.Println("Retention: failed to archive jobs", err)
+		}
+	}
+}
+
+/*
+Writes the jobs that finished at least ArchiveGrace before now to the archive of the day, a gzipped
+file of JSON lines, then lets them expire. Returns how many jobs were archived.
+*/
+func (keeper *Keeper) Archive(now time.Time) (int, error) {
+	archived := 0
+	for {
+		count, more, err := keeper.archiveBatch(now)
+		archived += count
+		if err != nil || !more {
+			return archived, err
+		}
+	}
+}
+
+/*
+Archives a batch of jobs. A job is claimed by removing it from the archive queue, so a single
+controller writes it, and claimed jobs go back in the queue if anything fails before they are written.
+*/
+func (keeper *Keeper) archiveBatch(now time.Time) (int, bool, error) {
+	db := keeper.pool.Get()
+	defer db.Close()
+
+	pending, err := redis.Strings(db.Do("ZRANGEBYSCORE", zsetJobsArchive, "-inf", now.Add(-ArchiveGrace).Unix(),
+		"WITHSCORES", "LIMIT", 0, archiveBatchSize))
+	if err != nil {
+		return 0, false, err
+	}
+
+	claimed := make(map[string]int64)
+	unclaim := func(err error) (int, bool, error) {
+		keeper.requeue(claimed)
+		return 0, false, err
+	}
+
+	var records []*Record
+	for i := 0; i+1 < len(pending); i += 2 {
+		id := pending[i]
+		finished, _ := strconv.ParseInt(pending[i+1], 10, 64)
+
+		//another controller may have claimed it already
+		removed, err := redis.Int(db.Do("ZREM", zsetJobsArchive, id))
+		if err != nil {
+			return unclaim(err)
+		}
+		if removed == 0 {
+			continue
+		}
+		claimed[id] = finished
+
+		results, final, err := results(db, id)
+		if err != nil {
+			return unclaim(err)
+		}
+		//it is queued again when it finishes
+		if !final {
+			delete(claimed, id)
+			continue
+		}
+
+		dumps, err := redis.Strings(db.Do("LRANGE", fmt.Sprintf(listJobLogs, id), 0, -1))
+		if err != nil {
+			return unclaim(err)
+		}
+
+		record := &Record{ID: id, Finished: finished, Results: results}
+		for _, dump := range dumps {
+			record.Logs = append(record.Logs, json.RawMessage(dump))
+		}
+		records = append(records, record)
+	}
+
+	if len(records) == 0 {
+		return 0, len(pending) == 2*archiveBatchSize, nil
+	}
+
+	if err := writeArchive(keeper.options.ArchiveDir, now, records); err != nil {
+		return unclaim(err)
+	}
+
+	db.Send("MULTI")
+	for _, record := range records {
+		keeper.expire(db, record.ID, record.Results)
+	}
+	if _, err := db.Do("EXEC"); err != nil {
+		return len(records), false, err
+	}
+
+	return len(records), len(pending) == 2*archiveBatchSize, nil
+}
+
+// Puts claimed jobs back in the archive queue, the next run tries again
+func (keeper *Keeper) requeue(claimed map[string]int64) {
+	if len(claimed) == 0 {
+		return
+	}
+
+	//the connection of the batch may be the one that failed
+	db := keeper.pool.Get()
+	defer db.Close()
+
+	for id, finished := range claimed {
+		if _, err := db.Do("ZADD", zsetJobsArchive, finished, id); err != nil {
+			log.Println("Retention: failed to queue job", id, "for archiving again", err)
+		}
+	}
+}
+
+/*
+Appends the records to the archive of the day in dir as a new gzip member. Readers that handle
+concatenated gzip members, like gunzip and zcat, see a single file of JSON lines.
+*/
+func writeArchive(dir string, now time.Time, records []*Record) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, "jobs-"+now.UTC().Format("2006-01-02")+".jsonl.gz")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compressed := gzip.NewWriter(file)
+	encoder := json.NewEncoder(compressed)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
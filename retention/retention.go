@@ -0,0 +1,168 @@
+// Retention of the results, queues and logs of the jobs once they are finished
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	hashCmdResults        = "jobresult:%s"
+	cmdQueueAgentResponse = "cmd.%s.%d.%d"
+	cmdQueueCmdQueued     = "cmd.%s.queued"
+	listJobLogs           = "joblogs:%s"
+	listJoblog            = "joblog"
+
+	// The finished jobs, scored by the unix time they finished at
+	zsetJobsFinished = "jobs.finished"
+	// The finished jobs waiting to be archived, scored the same way
+	zsetJobsArchive = "jobs.archive"
+
+	DefaultTTL        = 7 * 24 * time.Hour
+	DefaultJoblogSize = 100000
+)
+
+// How long finished jobs are kept, and where they are archived if anywhere
+type Options struct {
+	// The results, queues and logs of a job expire that long after it finished
+	TTL time.Duration
+	// The joblog list of dispatched commands is capped to that many
+	JoblogSize int
+	// Finished jobs are written to that directory before they start expiring, if set
+	ArchiveDir string
+}
+
+// Applies the retention to the jobs as they finish
+type Keeper struct {
+	pool    *redis.Pool
+	options Options
+}
+
+func NewKeeper(pool *redis.Pool, options Options) *Keeper {
+	if options.TTL <= 0 {
+		options.TTL = DefaultTTL
+	}
+	if options.JoblogSize <= 0 {
+		options.JoblogSize = DefaultJoblogSize
+	}
+
+	return &Keeper{pool: pool, options: options}
+}
+
+// Decodes the results of a job, they are final once none of them is queued or running
+func finalResults(dumps map[string]string) ([]*core.CommandResult, bool) {
+	results := make([]*core.CommandResult, 0, len(dumps))
+	for _, dump := range dumps {
+		result := &core.CommandResult{}
+		if err := json.Unmarshal([]byte(dump), result); err != nil {
+			log.Println("Retention: skipping malformed result", err)
+			continue
+		}
+		if result.State == core.COMMAND_STATE_QUEUED || result.State == core.COMMAND_STATE_RUNNING {
+			return nil, false
+		}
+		results = append(results, result)
+	}
+
+	return results, len(results) > 0
+}
+
+func results(db redis.Conn, id string) ([]*core.CommandResult, bool, error) {
+	dumps, err := redis.StringMap(db.Do("HGETALL", fmt.Sprintf(hashCmdResults, id)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	results, final := finalResults(dumps)
+	return results, final, nil
+}
+
+// The keys of a job in redis
+func keys(id string, results []*core.CommandResult) []interface{} {
+	keys := []interface{}{
+		fmt.Sprintf(hashCmdResults, id),
+		fmt.Sprintf(cmdQueueCmdQueued, id),
+		fmt.Sprintf(listJobLogs, id),
+	}
+	for _, result := range results {
+		keys = append(keys, fmt.Sprintf(cmdQueueAgentResponse, id, result.Gid, result.Nid))
+	}
+	return keys
+}
+
+/*
+Applies the retention to a job whose result just changed, if it is finished: its keys start expiring
+or, when archiving, it waits for the archiver that expires them once written.
+*/
+func (keeper *Keeper) Finished(id string) error {
+	db := keeper.pool.Get()
+	defer db.Close()
+
+	results, final, err := results(db, id)
+	if err != nil || !final {
+		return err
+	}
+
+	now := time.Now()
+
+	db.Send("MULTI")
+	db.Send("ZADD", zsetJobsFinished, now.Unix(), id)
+	//jobs in the index longer than the retention are gone already
+	db.Send("ZREMRANGEBYSCORE", zsetJobsFinished, "-inf", now.Add(-keeper.options.TTL).Unix())
+	db.Send("LTRIM", listJoblog, 0, keeper.options.JoblogSize-1)
+	if keeper.options.ArchiveDir != "" {
+		db.Send("ZADD", zsetJobsArchive, now.Unix(), id)
+	} else {
+		keeper.expire(db, id, results)
+	}
+	_, err = db.Do("EXEC")
+
+	return err
+}
+
+// Queues the expiry of the keys of a job, within a MULTI
+func (keeper *Keeper) expire(db redis.Conn, id string, results []*core.CommandResult) {
+	ttl := int64(keeper.options.TTL / time.Second)
+	for _, key := range keys(id, results) {
+		db.Send("EXPIRE", key, ttl)
+	}
+}
+
+// Deletes the jobs that finished before the given time, archiving those not archived yet first
+func (keeper *Keeper) Purge(before time.Time) (int, error) {
+	if keeper.options.ArchiveDir != "" {
+		if _, err := keeper.Archive(before.Add(ArchiveGrace)); err != nil {
+			return 0, err
+		}
+	}
+
+	db := keeper.pool.Get()
+	defer db.Close()
+
+	ids, err := redis.Strings(db.Do("ZRANGEBYSCORE", zsetJobsFinished, "-inf", before.Unix()))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		results, _, err := results(db, id)
+		if err != nil {
+			return 0, err
+		}
+
+		db.Send("MULTI")
+		db.Send("DEL", keys(id, results)...)
+		db.Send("ZREM", zsetJobsFinished, id)
+		db.Send("ZREM", zsetJobsArchive, id)
+		if _, err := db.Do("EXEC"); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), nil
+}
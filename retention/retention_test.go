@@ -0,0 +1,71 @@
+package retention
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFinalResults(t *testing.T) {
+
+	_, final := finalResults(map[string]string{})
+	assert.False(t, final)
+
+	_, final = finalResults(map[string]string{
+		"1:1": `{"id": "job", "gid": 1, "nid": 1, "state": "SUCCESS"}`,
+		"1:2": `{"id": "job", "gid": 1, "nid": 2, "state": "RUNNING"}`,
+	})
+	assert.False(t, final)
+
+	results, final := finalResults(map[string]string{
+		"1:1": `{"id": "job", "gid": 1, "nid": 1, "state": "SUCCESS"}`,
+		"1:2": `{"id": "job", "gid": 1, "nid": 2, "state": "ERROR"}`,
+	})
+	assert.True(t, final)
+	assert.Len(t, results, 2)
+	assert.Len(t, keys("job", results), 5)
+}
+
+func TestWriteArchiveAppends(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "archive")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2015, 10, 16, 12, 0, 0, 0, time.UTC)
+	first := &Record{
+		ID:       "job-1",
+		Finished: now.Unix(),
+		Results:  []*core.CommandResult{{ID: "job-1", Gid: 1, Nid: 1, State: "SUCCESS"}},
+		Logs:     []json.RawMessage{json.RawMessage(`{"id":"job-1","message":"hello"}`)},
+	}
+	second := &Record{ID: "job-2", Finished: now.Unix()}
+
+	assert.NoError(t, writeArchive(dir, now, []*Record{first}))
+	assert.NoError(t, writeArchive(dir, now, []*Record{second}))
+
+	file, err := os.Open(filepath.Join(dir, "jobs-2015-10-16.jsonl.gz"))
+	assert.NoError(t, err)
+	defer file.Close()
+
+	uncompressed, err := gzip.NewReader(file)
+	assert.NoError(t, err)
+
+	var ids []string
+	scanner := bufio.NewScanner(uncompressed)
+	for scanner.Scan() {
+		record := &Record{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), record))
+		ids = append(ids, record.ID)
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, []string{"job-1", "job-2"}, ids)
+}
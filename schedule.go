@@ -2,48 +2,376 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
 	"github.com/robfig/cron"
 	"log"
+	"math/rand"
+	"sync"
+	"time"
 	"github.com/amrhassan/agentcontroller2/core"
 )
 
 const (
-	hashScheduleKey = "controller.schedule"
+	hashScheduleKey        = "controller.schedule"
+	listScheduleHistoryKey = "controller.schedule.history.%s"
+	hashScheduleRunsKey    = "controller.schedule.runs"
+	scheduleHistorySize    = 100
+
+	//how long the history of a job is kept after it ran for the last time
+	finishedScheduleHistoryRetention = 7 * 24 * 3600
+
+	scheduleTypeCron = "cron"
+	scheduleTypeAt   = "at"
 )
 
+/*
+Scheduler fires the jobs in the controller.schedule hash. Every controller runs one, but only
+the one holding the leader lease in redis actually fires jobs, the others stand by to take over.
+Every controller keeps all the jobs armed, changes are applied per job and broadcast on the
+controller.schedule.changes channel.
+*/
 type Scheduler struct {
-	cron *cron.Cron
 	pool *redis.Pool
+
+	entries     map[string]*scheduleEntry
+	entriesLock sync.Mutex
+
+	instance     string
+	leaseTimeout time.Duration
+	leaderLock   sync.RWMutex
+	leader       bool
 }
 
 type SchedulerJob struct {
 	ID   string                 `json:"id"`
-	Cron string                 `json:"cron"`
-	Cmd  map[string]interface{} `json:"cmd"`
+	Type string                 `json:"type"`
+	Cron string                 `json:"cron,omitempty"`
+	//At is the unix time a one-shot job runs at
+	At  int64                  `json:"at,omitempty"`
+	Cmd map[string]interface{} `json:"cmd"`
+	//Enabled is false for paused jobs, they are kept but don't run
+	Enabled bool `json:"enabled"`
+	//Misfire is the policy for the runs missed while no controller was leading: skip, once or all
+	Misfire string `json:"misfire,omitempty"`
+	//MisfireLimit caps the missed runs made up for by the all policy
+	MisfireLimit int `json:"misfire_limit,omitempty"`
+	//Timezone the cron spec is evaluated in, an IANA name like "Europe/Brussels", local time if empty
+	Timezone string `json:"timezone,omitempty"`
+	//Jitter delays every run by a random amount of seconds up to it, to spread fanout jobs
+	Jitter int `json:"jitter,omitempty"`
+	//MaxRuns removes the job once it ran that many times, unlimited if 0
+	MaxRuns int `json:"max_runs,omitempty"`
+	//NotAfter is an RFC 3339 time after which the job is removed instead of run
+	NotAfter string `json:"not_after,omitempty"`
+	//Concurrency is the policy when the previous run is unfinished: allow, skip or replace
+	Concurrency string `json:"concurrency,omitempty"`
+	//Managed jobs come from the configuration and can't be added or removed at runtime
+	Managed bool `json:"managed,omitempty"`
+
+	scheduler *Scheduler
+}
+
+//scheduleAtRequest is the data of a scheduler_at command, either At or Delay is required
+type scheduleAtRequest struct {
+	//At is an RFC 3339 time
+	At string `json:"at"`
+	//Delay in seconds from now
+	Delay int64                  `json:"delay"`
+	Cmd   map[string]interface{} `json:"cmd"`
+}
+
+//onceSchedule is a cron.Schedule that fires a single time, right away if its time already passed
+type onceSchedule struct {
+	at    time.Time
+	fired bool
+}
+
+func (schedule *onceSchedule) Next(t time.Time) time.Time {
+	if schedule.fired {
+		return time.Time{}
+	}
+	schedule.fired = true
+	if schedule.at.Before(t) {
+		return t
+	}
+	return schedule.at
+}
+
+//locatedSchedule evaluates a cron.Schedule in a given timezone
+type locatedSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+func (schedule *locatedSchedule) Next(t time.Time) time.Time {
+	return schedule.schedule.Next(t.In(schedule.location))
+}
+
+//ScheduleStatus is a scheduled job as reported by scheduler_list and scheduler_status
+type ScheduleStatus struct {
+	*SchedulerJob
+	//Next is the unix time of the next run, 0 if it won't run again or is paused
+	Next int64 `json:"next"`
+	//Paused jobs are kept but don't run until they are resumed
+	Paused bool `json:"paused"`
+	//Runs is how many times the job ran, as counted for max_runs
+	Runs int `json:"runs"`
+}
+
+//ScheduleRun records a single run of a scheduled job
+type ScheduleRun struct {
+	Time      int64  `json:"time"`
+	CommandID string `json:"cmd_id"`
+	//Error is set if the command couldn't be pushed to the commands queue
+	Error string `json:"error,omitempty"`
 }
 
 func (job *SchedulerJob) Run() {
-	db := pool.Get()
+	if !job.scheduler.IsLeader() {
+		return
+	}
+
+	db := job.scheduler.pool.Get()
 	defer db.Close()
 
-	job.Cmd["id"] = uuid.New()
+	if finished, reason := job.finished(db, time.Now()); finished {
+		log.Println("Scheduler: removing job", job.ID, "instead of running it,", reason)
+		job.scheduler.retire(db, job.ID)
+		return
+	}
+
+	if job.Jitter > 0 {
+		time.Sleep(time.Duration(rand.Intn(job.Jitter+1)) * time.Second)
+	}
+
+	if !job.mayRun(db) {
+		schedulerFires.Inc("skipped")
+		return
+	}
+
+	//every run gets its own copy of the command, runs may overlap
+	cmd := make(map[string]interface{}, len(job.Cmd)+1)
+	for key, value := range job.Cmd {
+		cmd[key] = value
+	}
+	cmd["id"] = uuid.New()
+
+	run := &ScheduleRun{
+		Time:      time.Now().Unix(),
+		CommandID: cmd["id"].(string),
+	}
 
-	dump, _ := json.Marshal(job.Cmd)
+	dump, _ := json.Marshal(cmd)
 
-	log.Println("Scheduler: Running job", job.ID, job.Cmd["id"])
+	log.Println("Scheduler: Running job", job.ID, cmd["id"])
 
-	_, err := db.Do("RPUSH", cmdQueueMain, string(dump))
+	//one-shot jobs are removed by the same script that pushes them so they can only run once
+	once := ""
+	if job.Type == scheduleTypeAt {
+		once = job.ID
+	}
+
+	pushed, err := redis.Int(leaderPushScript.Do(db, scheduleLeaderKey, cmdQueueMain, hashScheduleKey,
+		job.scheduler.instance, string(dump), once))
 	if err != nil {
 		log.Println("Failed to run scheduled command", job.ID)
+		run.Error = err.Error()
+		schedulerFires.Inc("error")
+	} else if pushed == 0 {
+		log.Println("Scheduler: not running job", job.ID, "after losing the leader lease")
+		return
+	} else if pushed < 0 {
+		log.Println("Scheduler: one-shot job", job.ID, "already ran or was removed")
+		return
+	}
+
+	if run.Error == "" {
+		schedulerFires.Inc("pushed")
+	}
+	recordScheduleRun(db, job.ID, run)
+
+	if job.Type == scheduleTypeAt {
+		db.Do("EXPIRE", fmt.Sprintf(listScheduleHistoryKey, job.ID), finishedScheduleHistoryRetention)
+		if run.Error == "" {
+			job.scheduler.changed(db, job.ID)
+		}
+		return
+	}
+
+	if run.Error != "" {
+		return
+	}
+
+	recordScheduleFire(db, job.ID, time.Unix(run.Time, 0))
+
+	if job.MaxRuns > 0 {
+		runs, err := redis.Int(db.Do("HINCRBY", hashScheduleRunsKey, job.ID, 1))
+		if err != nil {
+			log.Println("Failed to count schedule run", job.ID, err)
+		} else if runs >= job.MaxRuns {
+			log.Println("Scheduler: job", job.ID, "reached its", job.MaxRuns, "max runs, removing it")
+			job.scheduler.retire(db, job.ID)
+		}
+	}
+}
+
+//finished checks the end conditions of a job, it should be removed instead of run if they are met
+func (job *SchedulerJob) finished(db redis.Conn, now time.Time) (bool, string) {
+	if job.NotAfter != "" {
+		notAfter, err := time.Parse(time.RFC3339, job.NotAfter)
+		if err == nil && now.After(notAfter) {
+			return true, "it is past its not_after time " + job.NotAfter
+		}
 	}
+
+	if job.MaxRuns > 0 {
+		runs, err := redis.Int(db.Do("HGET", hashScheduleRunsKey, job.ID))
+		if err == nil && runs >= job.MaxRuns {
+			return true, "it reached its max runs"
+		}
+	}
+
+	return false, ""
 }
 
-func NewScheduler(pool *redis.Pool) *Scheduler {
+//validate checks the definition of a cron job
+func (job *SchedulerJob) validate() error {
+	if _, err := cron.Parse(job.Cron); err != nil {
+		return err
+	}
+
+	if err := validMisfirePolicy(job.Misfire); err != nil {
+		return err
+	}
+
+	if err := validConcurrencyPolicy(job.Concurrency); err != nil {
+		return err
+	}
+
+	if job.Timezone != "" {
+		if _, err := time.LoadLocation(job.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %v", job.Timezone, err)
+		}
+	}
+
+	if job.Jitter < 0 {
+		return fmt.Errorf("jitter can't be negative")
+	}
+
+	if job.MaxRuns < 0 {
+		return fmt.Errorf("max_runs can't be negative")
+	}
+
+	if job.NotAfter != "" {
+		notAfter, err := time.Parse(time.RFC3339, job.NotAfter)
+		if err != nil {
+			return fmt.Errorf("invalid not_after time: %v", err)
+		}
+		if notAfter.Before(time.Now()) {
+			return fmt.Errorf("not_after time %s already passed", job.NotAfter)
+		}
+	}
+
+	return nil
+}
+
+//recordScheduleRun keeps the latest scheduleHistorySize runs of a job, newest first
+func recordScheduleRun(db redis.Conn, id string, run *ScheduleRun) {
+	dump, err := json.Marshal(run)
+	if err != nil {
+		log.Println("Failed to serialize schedule run", id, err)
+		return
+	}
+
+	key := fmt.Sprintf(listScheduleHistoryKey, id)
+	db.Send("MULTI")
+	db.Send("LPUSH", key, dump)
+	db.Send("LTRIM", key, 0, scheduleHistorySize-1)
+	if _, err := db.Do("EXEC"); err != nil {
+		log.Println("Failed to record schedule run", id, err)
+	}
+}
+
+//updateScheduleScript replaces a job only if it still exists, so pausing a one-shot job can't
+//bring it back after it ran
+var updateScheduleScript = redis.NewScript(1, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+//parseSchedulerJob loads a job as stored in the schedule hash
+func parseSchedulerJob(id string, spec string) (*SchedulerJob, error) {
+	//jobs stored before they could be paused are enabled
+	job := &SchedulerJob{Enabled: true}
+	if err := json.Unmarshal([]byte(spec), job); err != nil {
+		return nil, err
+	}
+
+	job.ID = id
+	if job.Type == "" {
+		job.Type = scheduleTypeCron
+	}
+
+	return job, nil
+}
+
+//schedule returns a fresh cron.Schedule for the job
+func (job *SchedulerJob) schedule() (cron.Schedule, error) {
+	switch job.Type {
+	case scheduleTypeCron:
+		schedule, err := cron.Parse(job.Cron)
+		if err != nil || job.Timezone == "" {
+			return schedule, err
+		}
+		location, err := time.LoadLocation(job.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		return &locatedSchedule{schedule: schedule, location: location}, nil
+	case scheduleTypeAt:
+		return &onceSchedule{at: time.Unix(job.At, 0)}, nil
+	default:
+		return nil, fmt.Errorf("unknown schedule type %q", job.Type)
+	}
+}
+
+//Next returns the time of the next run after now, or the zero time if it won't run again
+func (job *SchedulerJob) Next(now time.Time) time.Time {
+	if !job.Enabled {
+		return time.Time{}
+	}
+	schedule, err := job.schedule()
+	if err != nil {
+		return time.Time{}
+	}
+	return schedule.Next(now)
+}
+
+func (job *SchedulerJob) status(now time.Time, runs int) *ScheduleStatus {
+	status := &ScheduleStatus{SchedulerJob: job, Runs: runs, Paused: !job.Enabled}
+	if next := job.Next(now); !next.IsZero() {
+		status.Next = next.Unix()
+	}
+	return status
+}
+
+//NewScheduler creates a scheduler, a standby takes over firing jobs when the leader hasn't renewed
+//its lease for leaseTimeout
+func NewScheduler(pool *redis.Pool, leaseTimeout time.Duration) *Scheduler {
+	if leaseTimeout <= 0 {
+		leaseTimeout = defaultScheduleLeaseTimeout
+	}
+
 	sched := &Scheduler{
-		cron: cron.New(),
-		pool: pool,
+		pool:         pool,
+		entries:      make(map[string]*scheduleEntry),
+		instance:     newSchedulerInstanceID(),
+		leaseTimeout: leaseTimeout,
 	}
 
 	return sched
@@ -51,8 +379,6 @@ func NewScheduler(pool *redis.Pool) *Scheduler {
 
 //create a schdule with the cmd ID (overrides old ones) and
 func (sched *Scheduler) Add(cmd *core.Command) (interface{}, error) {
-	defer sched.restart()
-
 	db := sched.pool.Get()
 	defer db.Close()
 
@@ -65,83 +391,279 @@ func (sched *Scheduler) Add(cmd *core.Command) (interface{}, error) {
 		return nil, err
 	}
 
-	_, err = cron.Parse(job.Cron)
-	if err != nil {
+	if err := job.validate(); err != nil {
 		return nil, err
 	}
 
+	if managed, err := sched.managed(db, cmd.ID); err != nil {
+		return nil, err
+	} else if managed {
+		return nil, errManagedJob(cmd.ID)
+	}
+
 	job.ID = cmd.ID
-	//we can safely push the command to the hashset now.
-	db.Do("HSET", hashScheduleKey, cmd.ID, cmd.Data)
+	job.Type = scheduleTypeCron
+	job.Enabled = true
+	job.Managed = false
+
+	dump, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	//we can safely push the command to the hashset now, overriding a job also resets its run count.
+	db.Do("HSET", hashScheduleKey, cmd.ID, dump)
+	db.Do("HDEL", hashScheduleRunsKey, cmd.ID)
+	//the history of a job removed earlier under the same id would expire under the new one
+	db.Do("PERSIST", fmt.Sprintf(listScheduleHistoryKey, cmd.ID))
+	//runs missed from now on are caught up on according to the misfire policy
+	recordScheduleFire(db, cmd.ID, time.Now())
+
+	sched.changed(db, cmd.ID)
 
 	return true, nil
 }
 
+//AddAt creates a one-shot job with the cmd ID (overrides old ones), it is removed once it ran
+func (sched *Scheduler) AddAt(cmd *core.Command) (interface{}, error) {
+	request := &scheduleAtRequest{}
+	if err := json.Unmarshal([]byte(cmd.Data), request); err != nil {
+		log.Println("Failed to load command spec", cmd.Data, err)
+		return nil, err
+	}
+
+	if request.Cmd == nil {
+		return nil, fmt.Errorf("a cmd to run is required")
+	}
+
+	var at time.Time
+	switch {
+	case request.At != "" && request.Delay != 0:
+		return nil, fmt.Errorf("either at or delay is required, not both")
+	case request.At != "":
+		var err error
+		if at, err = time.Parse(time.RFC3339, request.At); err != nil {
+			return nil, err
+		}
+	case request.Delay > 0:
+		at = time.Now().Add(time.Duration(request.Delay) * time.Second)
+	default:
+		return nil, fmt.Errorf("either at or a positive delay is required")
+	}
+
+	job := &SchedulerJob{
+		ID:   cmd.ID,
+		Type: scheduleTypeAt,
+		At:      at.Unix(),
+		Cmd:     request.Cmd,
+		Enabled: true,
+	}
+
+	dump, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	db := sched.pool.Get()
+	defer db.Close()
+
+	if managed, err := sched.managed(db, cmd.ID); err != nil {
+		return nil, err
+	} else if managed {
+		return nil, errManagedJob(cmd.ID)
+	}
+
+	if _, err := db.Do("HSET", hashScheduleKey, cmd.ID, dump); err != nil {
+		return nil, err
+	}
+	//the history of a job removed earlier under the same id would expire under the new one
+	db.Do("PERSIST", fmt.Sprintf(listScheduleHistoryKey, cmd.ID))
+
+	sched.changed(db, cmd.ID)
+
+	return job.At, nil
+}
+
+//List returns all the scheduled jobs by id, along with the time they will run next and whether they are paused
 func (sched *Scheduler) List(cmd *core.Command) (interface{}, error) {
 	db := sched.pool.Get()
 	defer db.Close()
 
-	return redis.StringMap(db.Do("HGETALL", hashScheduleKey))
+	set, err := redis.StringMap(db.Do("HGETALL", hashScheduleKey))
+	if err != nil {
+		return nil, err
+	}
+
+	runs, err := redis.IntMap(db.Do("HGETALL", hashScheduleRunsKey))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	statuses := make(map[string]*ScheduleStatus, len(set))
+	for key, spec := range set {
+		job, err := parseSchedulerJob(key, spec)
+		if err != nil {
+			log.Println("Failed to load scheduled job", key, err)
+			continue
+		}
+
+		statuses[key] = job.status(now, runs[key])
+	}
+
+	return statuses, nil
 }
 
-func (sched *Scheduler) Remove(cmd *core.Command) (interface{}, error) {
+//Status is the same as List, for the clients of scheduler_status
+func (sched *Scheduler) Status(cmd *core.Command) (interface{}, error) {
+	return sched.List(cmd)
+}
+
+//Get returns the job with the cmd ID along with the time it will run next
+func (sched *Scheduler) Get(cmd *core.Command) (interface{}, error) {
 	db := sched.pool.Get()
 	defer db.Close()
 
-	value, err := redis.Int(db.Do("HDEL", hashScheduleKey, cmd.ID))
+	job, err := sched.get(db, cmd.ID)
+	if err != nil {
+		return nil, err
+	}
 
-	if value > 0 {
-		//actuall job was deleted. need to restart the scheduler
-		sched.restart()
+	runs, err := redis.Int(db.Do("HGET", hashScheduleRunsKey, cmd.ID))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
 	}
 
-	return value, err
+	return job.status(time.Now(), runs), nil
 }
 
-func (sched *Scheduler) restart() {
-	sched.cron.Stop()
-	sched.cron = cron.New()
-	sched.Start()
+//Pause keeps the job with the cmd ID from running until it is resumed
+func (sched *Scheduler) Pause(cmd *core.Command) (interface{}, error) {
+	return sched.setEnabled(cmd.ID, false)
 }
 
-func (sched *Scheduler) Start() {
+//Resume lets a paused job run again, a one-shot job that missed its time runs right away
+func (sched *Scheduler) Resume(cmd *core.Command) (interface{}, error) {
+	return sched.setEnabled(cmd.ID, true)
+}
+
+func (sched *Scheduler) setEnabled(id string, enabled bool) (interface{}, error) {
 	db := sched.pool.Get()
 	defer db.Close()
 
-	var cursor int
-	for {
-		slice, err := redis.Values(db.Do("HSCAN", hashScheduleKey, cursor))
-		if err != nil {
-			log.Println("Failed to load schedule from redis", err)
-			break
-		}
+	job, err := sched.get(db, id)
+	if err != nil {
+		return nil, err
+	}
 
-		var fields interface{}
-		if _, err := redis.Scan(slice, &cursor, &fields); err == nil {
-			set, _ := redis.StringMap(fields, nil)
+	if job.Enabled == enabled {
+		return false, nil
+	}
+
+	job.Enabled = enabled
+	dump, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
 
-			for key, cmd := range set {
-				job := &SchedulerJob{}
+	updated, err := redis.Int(updateScheduleScript.Do(db, hashScheduleKey, id, dump))
+	if err != nil {
+		return nil, err
+	}
+	if updated == 0 {
+		return nil, fmt.Errorf("no scheduled job with id %s", id)
+	}
 
-				err := json.Unmarshal([]byte(cmd), job)
+	if enabled {
+		//the runs missed while paused aren't caught up on
+		recordScheduleFire(db, id, time.Now())
+	}
 
-				if err != nil {
-					log.Println("Failed to load scheduled job", key, err)
-					continue
-				}
+	sched.changed(db, id)
 
-				job.ID = key
-				sched.cron.AddJob(job.Cron, job)
-			}
-		} else {
-			log.Println(err)
-			break
-		}
+	return true, nil
+}
+
+func (sched *Scheduler) get(db redis.Conn, id string) (*SchedulerJob, error) {
+	spec, err := redis.String(db.Do("HGET", hashScheduleKey, id))
+	if err == redis.ErrNil {
+		return nil, fmt.Errorf("no scheduled job with id %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		if cursor == 0 {
-			break
+	return parseSchedulerJob(id, spec)
+}
+
+//History returns the recorded runs of the job with the cmd ID, newest first
+func (sched *Scheduler) History(cmd *core.Command) (interface{}, error) {
+	db := sched.pool.Get()
+	defer db.Close()
+
+	dumps, err := redis.Strings(db.Do("LRANGE", fmt.Sprintf(listScheduleHistoryKey, cmd.ID), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]*ScheduleRun, 0, len(dumps))
+	for _, dump := range dumps {
+		run := &ScheduleRun{}
+		if err := json.Unmarshal([]byte(dump), run); err != nil {
+			log.Println("Failed to load schedule run", cmd.ID, err)
+			continue
 		}
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+func (sched *Scheduler) Remove(cmd *core.Command) (interface{}, error) {
+	db := sched.pool.Get()
+	defer db.Close()
+
+	if managed, err := sched.managed(db, cmd.ID); err != nil {
+		return nil, err
+	} else if managed {
+		return nil, errManagedJob(cmd.ID)
 	}
 
-	sched.cron.Start()
+	return sched.remove(db, cmd.ID)
+}
+
+func (sched *Scheduler) remove(db redis.Conn, id string) (int, error) {
+	value, err := redis.Int(db.Do("HDEL", hashScheduleKey, id))
+
+	if value > 0 {
+		//actuall job was deleted. need to disarm it everywhere, its history is kept for a while
+		db.Do("HDEL", hashScheduleLastFireKey, id)
+		db.Do("HDEL", hashScheduleRunsKey, id)
+		db.Do("EXPIRE", fmt.Sprintf(listScheduleHistoryKey, id), finishedScheduleHistoryRetention)
+		sched.changed(db, id)
+	}
+
+	return value, err
+}
+
+//retire removes a job that met its end conditions, its history is kept for a while
+func (sched *Scheduler) retire(db redis.Conn, id string) {
+	if _, err := db.Do("HDEL", hashScheduleKey, id); err != nil {
+		log.Println("Failed to remove finished job", id, err)
+		return
+	}
+
+	db.Do("HDEL", hashScheduleLastFireKey, id)
+	db.Do("HDEL", hashScheduleRunsKey, id)
+	db.Do("EXPIRE", fmt.Sprintf(listScheduleHistoryKey, id), finishedScheduleHistoryRetention)
+
+	sched.changed(db, id)
+}
+
+func (sched *Scheduler) Start() {
+	sched.refreshLease()
+	go sched.lead()
+
+	sched.load()
+	go sched.watch()
 }
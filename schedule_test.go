@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerList(t *testing.T) {
+
+	sched := NewScheduler(newFakeRedis().pool(), 0)
+	_, err := sched.Add(&core.Command{ID: "job", Data: `{"cron": "0 0 0 1 1 *", "cmd": {"cmd": "ping"}}`})
+	assert.NoError(t, err)
+	_, err = sched.Add(&core.Command{ID: "paused", Data: `{"cron": "0 0 0 1 1 *", "cmd": {"cmd": "ping"}}`})
+	assert.NoError(t, err)
+	_, err = sched.Pause(&core.Command{ID: "paused"})
+	assert.NoError(t, err)
+
+	list, err := sched.List(nil)
+	assert.NoError(t, err)
+	statuses, ok := list.(map[string]*ScheduleStatus)
+	if !assert.True(t, ok) || !assert.Len(t, statuses, 2) {
+		return
+	}
+
+	job := statuses["job"]
+	assert.Equal(t, "0 0 0 1 1 *", job.Cron)
+	next := time.Unix(job.Next, 0)
+	assert.True(t, next.After(time.Now()))
+	assert.Equal(t, time.January, next.Month())
+	assert.Equal(t, 1, next.Day())
+	assert.False(t, job.Paused)
+	assert.Equal(t, 0, job.Runs)
+
+	assert.True(t, statuses["paused"].Paused)
+	assert.Zero(t, statuses["paused"].Next)
+
+	status, err := sched.Status(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, list, status)
+}
+
+func TestSchedulerRemoveKeepsHistory(t *testing.T) {
+
+	fake := newFakeRedis()
+	sched := NewScheduler(fake.pool(), 0)
+	_, err := sched.Add(&core.Command{ID: "job", Data: `{"cron": "0 0 0 1 1 *", "cmd": {"cmd": "ping"}}`})
+	assert.NoError(t, err)
+
+	db := fake.pool().Get()
+	recordScheduleRun(db, "job", &ScheduleRun{Time: 1, CommandID: "run"})
+	db.Close()
+
+	removed, err := sched.Remove(&core.Command{ID: "job"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	history, err := sched.History(&core.Command{ID: "job"})
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, int64(finishedScheduleHistoryRetention), fake.ttls["controller.schedule.history.job"])
+}
+
+func TestSchedulerAddAfterRemoveKeepsHistory(t *testing.T) {
+
+	fake := newFakeRedis()
+	sched := NewScheduler(fake.pool(), 0)
+	history := "controller.schedule.history.job"
+
+	db := fake.pool().Get()
+	defer db.Close()
+
+	for _, add := range []func(*core.Command) (interface{}, error){sched.Add, sched.AddAt} {
+		_, err := sched.Add(&core.Command{ID: "job", Data: `{"cron": "0 0 0 1 1 *", "cmd": {"cmd": "ping"}}`})
+		assert.NoError(t, err)
+		recordScheduleRun(db, "job", &ScheduleRun{Time: 1, CommandID: "run"})
+
+		_, err = sched.Remove(&core.Command{ID: "job"})
+		assert.NoError(t, err)
+		assert.Contains(t, fake.ttls, history)
+
+		//the history belongs to the job again, it no longer expires
+		_, err = add(&core.Command{ID: "job", Data: `{"cron": "0 0 0 1 1 *", "delay": 60, "cmd": {"cmd": "ping"}}`})
+		assert.NoError(t, err)
+		assert.NotContains(t, fake.ttls, history)
+		assert.NotEmpty(t, fake.lists[history])
+	}
+}
+
+func TestOnceScheduleNext(t *testing.T) {
+
+	now := time.Now()
+
+	later := &onceSchedule{at: now.Add(time.Hour)}
+	assert.Equal(t, now.Add(time.Hour), later.Next(now))
+	assert.True(t, later.Next(now).IsZero())
+
+	//a time that already passed runs right away
+	missed := &onceSchedule{at: now.Add(-time.Hour)}
+	assert.Equal(t, now, missed.Next(now))
+	assert.True(t, missed.Next(now).IsZero())
+}
+
+func TestLocatedScheduleNext(t *testing.T) {
+
+	brussels, err := time.LoadLocation("Europe/Brussels")
+	if err != nil {
+		t.Skip("no timezone database", err)
+	}
+
+	job := &SchedulerJob{Type: scheduleTypeCron, Cron: "0 0 2 * * *", Timezone: "Europe/Brussels", Enabled: true}
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	next := job.Next(now)
+	assert.True(t, next.Equal(time.Date(2016, 1, 2, 2, 0, 0, 0, brussels)), next.String())
+	assert.True(t, next.Equal(time.Date(2016, 1, 2, 1, 0, 0, 0, time.UTC)), next.String())
+
+	job.Enabled = false
+	assert.True(t, job.Next(now).IsZero())
+}
+
+func TestSchedulerJobValidate(t *testing.T) {
+
+	valid := func() *SchedulerJob {
+		return &SchedulerJob{Cron: "0 0 * * * *", Timezone: "UTC", Jitter: 10, MaxRuns: 3,
+			NotAfter: time.Now().Add(time.Hour).Format(time.RFC3339)}
+	}
+	assert.NoError(t, valid().validate())
+
+	broken := []func(job *SchedulerJob){
+		func(job *SchedulerJob) { job.Cron = "not a cron spec" },
+		func(job *SchedulerJob) { job.Misfire = "sometimes" },
+		func(job *SchedulerJob) { job.Concurrency = "maybe" },
+		func(job *SchedulerJob) { job.Timezone = "Nowhere/Land" },
+		func(job *SchedulerJob) { job.Jitter = -1 },
+		func(job *SchedulerJob) { job.MaxRuns = -1 },
+		func(job *SchedulerJob) { job.NotAfter = "tomorrow" },
+		func(job *SchedulerJob) { job.NotAfter = time.Now().Add(-time.Hour).Format(time.RFC3339) },
+	}
+	for i, breaks := range broken {
+		job := valid()
+		breaks(job)
+		assert.Error(t, job.validate(), "case %d", i)
+	}
+}
+
+func TestSchedulerJobFinished(t *testing.T) {
+
+	fake := newFakeRedis()
+	db := fake.pool().Get()
+	defer db.Close()
+
+	now := time.Now()
+	job := &SchedulerJob{ID: "job", MaxRuns: 2, NotAfter: now.Add(time.Hour).Format(time.RFC3339)}
+
+	finished, _ := job.finished(db, now)
+	assert.False(t, finished)
+
+	finished, _ = job.finished(db, now.Add(2*time.Hour))
+	assert.True(t, finished)
+
+	fake.hash(hashScheduleRunsKey)["job"] = "2"
+	finished, _ = job.finished(db, now)
+	assert.True(t, finished)
+}
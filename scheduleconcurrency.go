@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+const (
+	//concurrency policies, what to do when a job fires while its previous run is unfinished
+	concurrencyAllow   = "allow"
+	concurrencySkip    = "skip"
+	concurrencyReplace = "replace"
+
+	//a run without any result yet is considered waiting in the commands queue for that long
+	scheduleDispatchGrace = time.Minute
+
+	cmdKill = "kill"
+)
+
+func validConcurrencyPolicy(policy string) error {
+	switch policy {
+	case "", concurrencyAllow, concurrencySkip, concurrencyReplace:
+		return nil
+	default:
+		return fmt.Errorf("unknown concurrency policy %q, expected %s, %s or %s", policy, concurrencyAllow, concurrencySkip, concurrencyReplace)
+	}
+}
+
+//previousRun returns the latest run of a job that made it to the commands queue, nil if none
+func previousRun(db redis.Conn, id string) (*ScheduleRun, error) {
+	dumps, err := redis.Strings(db.Do("LRANGE", fmt.Sprintf(listScheduleHistoryKey, id), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dump := range dumps {
+		run := &ScheduleRun{}
+		if err := json.Unmarshal([]byte(dump), run); err != nil {
+			continue
+		}
+		if run.Error == "" {
+			return run, nil
+		}
+	}
+
+	return nil, nil
+}
+
+/*
+unfinishedResults returns the results of the run that are still QUEUED or RUNNING. A run that has
+no results at all is still waiting to be dispatched, which counts as unfinished (pending) unless
+it's been waiting for longer than scheduleDispatchGrace.
+*/
+func unfinishedResults(db redis.Conn, run *ScheduleRun, now time.Time) (results []*core.CommandResult, pending bool, err error) {
+	dumps, err := redis.StringMap(db.Do("HGETALL", fmt.Sprintf(hashCmdResults, run.CommandID)))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(dumps) == 0 {
+		return nil, now.Sub(time.Unix(run.Time, 0)) < scheduleDispatchGrace, nil
+	}
+
+	for key, dump := range dumps {
+		result := &core.CommandResult{}
+		if err := json.Unmarshal([]byte(dump), result); err != nil {
+			log.Println("Failed to load result", run.CommandID, key, err)
+			continue
+		}
+
+		if result.State == core.COMMAND_STATE_QUEUED || result.State == core.COMMAND_STATE_RUNNING {
+			results = append(results, result)
+		}
+	}
+
+	return results, false, nil
+}
+
+/*
+mayRun applies the concurrency policy of the job before it runs, it returns false if the run
+must be skipped.
+	- allow (default): runs overlap freely
+	- skip: the run is skipped while the previous one is unfinished
+	- replace: the previous run is killed on the agents that didn't finish it yet
+*/
+func (job *SchedulerJob) mayRun(db redis.Conn) bool {
+	if job.Concurrency != concurrencySkip && job.Concurrency != concurrencyReplace {
+		return true
+	}
+
+	previous, err := previousRun(db, job.ID)
+	if err != nil {
+		log.Println("Scheduler: failed to check the previous run of job", job.ID, err)
+		return true
+	}
+	if previous == nil {
+		return true
+	}
+
+	unfinished, pending, err := unfinishedResults(db, previous, time.Now())
+	if err != nil {
+		log.Println("Scheduler: failed to check the previous run of job", job.ID, err)
+		return true
+	}
+	if len(unfinished) == 0 && !pending {
+		return true
+	}
+
+	if job.Concurrency == concurrencySkip {
+		log.Println("Scheduler: skipping job", job.ID, "its previous run", previous.CommandID, "is unfinished")
+		return false
+	}
+
+	if pending {
+		log.Println("Scheduler: previous run", previous.CommandID, "of job", job.ID, "isn't dispatched yet and can't be replaced")
+	}
+
+	for _, result := range unfinished {
+		job.kill(db, previous.CommandID, result.Gid, result.Nid)
+	}
+
+	return true
+}
+
+//kill asks an agent to stop a command it hasn't finished
+func (job *SchedulerJob) kill(db redis.Conn, id string, gid int, nid int) {
+	data, _ := json.Marshal(map[string]string{"id": id})
+	dump, _ := json.Marshal(&core.Command{
+		ID:   uuid.New(),
+		Gid:  gid,
+		Nid:  nid,
+		Cmd:  cmdKill,
+		Data: string(data),
+	})
+
+	log.Println("Scheduler: replacing run", id, "of job", job.ID, "killing it on", gid, nid)
+
+	if _, err := leaderPushScript.Do(db, scheduleLeaderKey, cmdQueueMain, hashScheduleKey,
+		job.scheduler.instance, string(dump), ""); err != nil {
+		log.Println("Scheduler: failed to kill run", id, "of job", job.ID, err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func storeResult(t *testing.T, fake *fakeRedis, id string, gid int, nid int, state string) {
+	dump, err := json.Marshal(&core.CommandResult{ID: id, Gid: gid, Nid: nid, State: state})
+	assert.NoError(t, err)
+	fake.hash("jobresult:" + id)[fmt.Sprintf("%d:%d", gid, nid)] = string(dump)
+}
+
+func TestUnfinishedResults(t *testing.T) {
+
+	fake := newFakeRedis()
+	db := fake.pool().Get()
+	defer db.Close()
+
+	now := time.Now()
+	run := &ScheduleRun{Time: now.Unix(), CommandID: "run"}
+
+	//a run without results is waiting in the commands queue, for a while
+	results, pending, err := unfinishedResults(db, run, now)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+	assert.True(t, pending)
+
+	_, pending, err = unfinishedResults(db, run, now.Add(2*scheduleDispatchGrace))
+	assert.NoError(t, err)
+	assert.False(t, pending)
+
+	storeResult(t, fake, "run", 1, 1, core.COMMAND_STATE_QUEUED)
+	storeResult(t, fake, "run", 1, 2, core.COMMAND_STATE_RUNNING)
+	storeResult(t, fake, "run", 1, 3, "SUCCESS")
+
+	results, pending, err = unfinishedResults(db, run, now)
+	assert.NoError(t, err)
+	assert.False(t, pending)
+	assert.Len(t, results, 2)
+}
+
+//concurrentJob is a job whose previous run is still running on agent 1:2
+func concurrentJob(t *testing.T, fake *fakeRedis, policy string) *SchedulerJob {
+	sched := NewScheduler(fake.pool(), 0)
+	fake.strings[scheduleLeaderKey] = sched.instance
+
+	db := fake.pool().Get()
+	defer db.Close()
+	recordScheduleRun(db, "job", &ScheduleRun{Time: time.Now().Unix(), CommandID: "previous"})
+	storeResult(t, fake, "previous", 1, 2, core.COMMAND_STATE_RUNNING)
+	storeResult(t, fake, "previous", 1, 3, "SUCCESS")
+
+	return &SchedulerJob{ID: "job", Concurrency: policy, scheduler: sched}
+}
+
+func TestMayRun(t *testing.T) {
+
+	fake := newFakeRedis()
+	db := fake.pool().Get()
+	defer db.Close()
+
+	assert.True(t, concurrentJob(t, fake, concurrencyAllow).mayRun(db))
+	assert.True(t, concurrentJob(t, fake, "").mayRun(db))
+
+	skip := concurrentJob(t, fake, concurrencySkip)
+	assert.False(t, skip.mayRun(db))
+	assert.Empty(t, fake.lists[cmdQueueMain])
+
+	//once the previous run finished, skip runs again
+	storeResult(t, fake, "previous", 1, 2, "SUCCESS")
+	assert.True(t, skip.mayRun(db))
+
+	//a job without previous runs always runs
+	first := &SchedulerJob{ID: "first", Concurrency: concurrencySkip}
+	assert.True(t, first.mayRun(db))
+}
+
+func TestMayRunReplaceKillsPreviousRun(t *testing.T) {
+
+	fake := newFakeRedis()
+	db := fake.pool().Get()
+	defer db.Close()
+
+	assert.True(t, concurrentJob(t, fake, concurrencyReplace).mayRun(db))
+
+	queue := fake.lists[cmdQueueMain]
+	if assert.Len(t, queue, 1) {
+		kill := &core.Command{}
+		assert.NoError(t, json.Unmarshal([]byte(queue[0]), kill))
+		assert.Equal(t, cmdKill, kill.Cmd)
+		assert.Equal(t, 1, kill.Gid)
+		assert.Equal(t, 2, kill.Nid)
+		assert.JSONEq(t, `{"id": "previous"}`, kill.Data)
+	}
+}
+
+func TestKillNeedsTheLease(t *testing.T) {
+
+	fake := newFakeRedis()
+	db := fake.pool().Get()
+	defer db.Close()
+
+	job := &SchedulerJob{ID: "job", scheduler: NewScheduler(fake.pool(), 0)}
+	fake.strings[scheduleLeaderKey] = "another controller"
+
+	job.kill(db, "previous", 1, 2)
+	assert.Empty(t, fake.lists[cmdQueueMain])
+}
+
+func TestMayRunOnceTheAgentPostedTheResult(t *testing.T) {
+
+	fake := newFakeRedis()
+	restInterface := newTestRestInterface(fake)
+	db := fake.pool().Get()
+	defer db.Close()
+
+	sched := NewScheduler(fake.pool(), 0)
+	job := &SchedulerJob{ID: "job", Concurrency: concurrencySkip, scheduler: sched}
+	run := &ScheduleRun{Time: time.Now().Unix(), CommandID: "previous"}
+	recordScheduleRun(db, "job", run)
+
+	agent := core.AgentID{GID: 1, NID: 2}
+	dispatch(t, fake, "previous", agent)
+	assert.False(t, job.mayRun(db))
+
+	postResult(t, restInterface.Handler(), "previous", agent, core.COMMAND_STATE_RUNNING)
+	assert.False(t, job.mayRun(db))
+
+	postResult(t, restInterface.Handler(), "previous", agent, "SUCCESS")
+	results, pending, err := unfinishedResults(db, run, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, pending)
+	assert.Empty(t, results)
+	assert.True(t, job.mayRun(db))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/garyburd/redigo/redis"
+)
+
+//errManagedJob returns the error for runtime changes to a job that is managed by the configuration
+func errManagedJob(id string) error {
+	return fmt.Errorf("job %s is managed by the configuration, change it there instead", id)
+}
+
+//managed returns true if the job with the given ID is managed by the configuration
+func (sched *Scheduler) managed(db redis.Conn, id string) (bool, error) {
+	spec, err := redis.String(db.Do("HGET", hashScheduleKey, id))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	job, err := parseSchedulerJob(id, spec)
+	if err != nil {
+		return false, nil
+	}
+
+	return job.Managed, nil
+}
+
+/*
+Reconcile makes the schedule match the jobs in the configuration. Configured jobs are added or
+updated, jobs that were configured before but aren't anymore are removed. Jobs keep their paused
+state across reconciles. A configured job never replaces a job added at runtime, the runtime one
+must be removed first. All the controllers sharing a redis should have the same schedule in
+their configuration, or they will undo each other's changes when they start.
+*/
+func (sched *Scheduler) Reconcile(configured []settings.ScheduledJob) error {
+	db := sched.pool.Get()
+	defer db.Close()
+
+	ids := make(map[string]bool, len(configured))
+	for _, entry := range configured {
+		if entry.ID == "" {
+			return fmt.Errorf("scheduled job without an id")
+		}
+		if ids[entry.ID] {
+			return fmt.Errorf("scheduled job %s is configured twice", entry.ID)
+		}
+		ids[entry.ID] = true
+
+		job := &SchedulerJob{
+			ID:      entry.ID,
+			Type:    scheduleTypeCron,
+			Cron:    entry.Cron,
+			Cmd:     entry.Cmd,
+			Enabled: true,
+			Managed: true,
+		}
+
+		if job.Cmd == nil {
+			return fmt.Errorf("scheduled job %s has no cmd", entry.ID)
+		}
+		if err := job.validate(); err != nil {
+			return fmt.Errorf("scheduled job %s: %v", entry.ID, err)
+		}
+
+		dump, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+
+		spec, err := redis.String(db.Do("HGET", hashScheduleKey, entry.ID))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+
+		if err == nil {
+			existing, err := parseSchedulerJob(entry.ID, spec)
+			if err != nil {
+				log.Println("Scheduler: replacing unreadable job", entry.ID, "by the configured one", err)
+			} else if !existing.Managed {
+				return fmt.Errorf("scheduled job %s is configured but was also added at runtime, remove it with scheduler_remove first", entry.ID)
+			} else {
+				job.Enabled = existing.Enabled
+				if existing.Cron == job.Cron && sameCommand(existing.Cmd, job.Cmd) {
+					continue
+				}
+			}
+
+			if dump, err = json.Marshal(job); err != nil {
+				return err
+			}
+		}
+
+		log.Println("Scheduler: scheduling configured job", entry.ID)
+		if _, err := db.Do("HSET", hashScheduleKey, entry.ID, dump); err != nil {
+			return err
+		}
+		db.Do("PERSIST", fmt.Sprintf(listScheduleHistoryKey, entry.ID))
+		recordScheduleFire(db, entry.ID, time.Now())
+		sched.changed(db, entry.ID)
+	}
+
+	set, err := redis.StringMap(db.Do("HGETALL", hashScheduleKey))
+	if err != nil {
+		return err
+	}
+
+	for key, spec := range set {
+		job, err := parseSchedulerJob(key, spec)
+		if err != nil || !job.Managed || ids[key] {
+			continue
+		}
+
+		log.Println("Scheduler: removing job", key, "that is no longer configured")
+		if _, err := sched.remove(db, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//sameCommand compares commands as they are stored, numbers from the configuration become floats once stored
+func sameCommand(stored map[string]interface{}, configured map[string]interface{}) bool {
+	dump, err := json.Marshal(configured)
+	if err != nil {
+		return false
+	}
+
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(dump, &normalized); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(stored, normalized)
+}
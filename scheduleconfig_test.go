@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameCommand(t *testing.T) {
+
+	stored := map[string]interface{}{"cmd": "ping", "gid": float64(1), "args": map[string]interface{}{"max_time": float64(10)}}
+
+	assert.True(t, sameCommand(stored, map[string]interface{}{"cmd": "ping", "gid": int64(1), "args": map[string]interface{}{"max_time": 10}}))
+	assert.False(t, sameCommand(stored, map[string]interface{}{"cmd": "ping", "gid": int64(2), "args": map[string]interface{}{"max_time": 10}}))
+	assert.False(t, sameCommand(stored, map[string]interface{}{"cmd": "ping", "gid": int64(1)}))
+}
+
+func configuredJob(id string, cron string) settings.ScheduledJob {
+	return settings.ScheduledJob{ID: id, Cron: cron, Cmd: map[string]interface{}{"cmd": "ping"}}
+}
+
+func TestReconcile(t *testing.T) {
+
+	fake := newFakeRedis()
+	sched := NewScheduler(fake.pool(), 0)
+
+	assert.NoError(t, sched.Reconcile([]settings.ScheduledJob{
+		configuredJob("kept", "0 0 0 1 1 *"),
+		configuredJob("changed", "0 0 0 1 1 *"),
+		configuredJob("dropped", "0 0 0 1 1 *"),
+	}))
+	_, err := sched.Pause(&core.Command{ID: "kept"})
+	assert.NoError(t, err)
+	kept := fake.hashes[hashScheduleKey]["kept"]
+
+	_, err = sched.Add(&core.Command{ID: "runtime", Data: `{"cron": "0 0 0 1 1 *", "cmd": {"cmd": "ping"}}`})
+	assert.NoError(t, err)
+
+	assert.NoError(t, sched.Reconcile([]settings.ScheduledJob{
+		configuredJob("kept", "0 0 0 1 1 *"),
+		configuredJob("changed", "0 0 0 * * *"),
+		configuredJob("added", "0 0 0 1 1 *"),
+	}))
+
+	schedule := fake.hashes[hashScheduleKey]
+	assert.Equal(t, kept, schedule["kept"])
+	assert.NotContains(t, schedule, "dropped")
+	assert.Contains(t, schedule, "added")
+	assert.Contains(t, schedule, "runtime")
+
+	changed, err := parseSchedulerJob("changed", schedule["changed"])
+	assert.NoError(t, err)
+	assert.Equal(t, "0 0 0 * * *", changed.Cron)
+	assert.True(t, changed.Managed)
+}
+
+func TestReconcileRefusesRuntimeJobs(t *testing.T) {
+
+	fake := newFakeRedis()
+	sched := NewScheduler(fake.pool(), 0)
+
+	_, err := sched.Add(&core.Command{ID: "job", Data: `{"cron": "0 0 0 1 1 *", "cmd": {"cmd": "ping"}}`})
+	assert.NoError(t, err)
+	runtime := fake.hashes[hashScheduleKey]["job"]
+
+	assert.Error(t, sched.Reconcile([]settings.ScheduledJob{configuredJob("job", "0 0 0 * * *")}))
+	assert.Equal(t, runtime, fake.hashes[hashScheduleKey]["job"])
+
+	assert.Error(t, sched.Reconcile([]settings.ScheduledJob{configuredJob("", "0 0 0 * * *")}))
+	assert.Error(t, sched.Reconcile([]settings.ScheduledJob{configuredJob("other", "not a cron spec")}))
+	assert.Error(t, sched.Reconcile([]settings.ScheduledJob{configuredJob("other", "0 0 0 * * *"), configuredJob("other", "0 0 0 * * *")}))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	//scheduleChangesChannel carries the ID of every job that was added, changed or removed
+	scheduleChangesChannel = "controller.schedule.changes"
+
+	//scheduleChangesKeepAlive pings the subscription well within the read timeout of the pool connections
+	scheduleChangesKeepAlive = 5 * time.Second
+	scheduleChangesRetry     = time.Second
+)
+
+//scheduleEntry is a job armed by this scheduler, it fires from its own goroutine until stopped
+type scheduleEntry struct {
+	job  *SchedulerJob
+	spec string
+	stop chan struct{}
+}
+
+func (entry *scheduleEntry) run(sched *Scheduler) {
+	schedule, err := entry.job.schedule()
+	if err != nil {
+		log.Println("Failed to load scheduled job", entry.job.ID, err)
+		return
+	}
+
+	for {
+		now := time.Now()
+		next := schedule.Next(now)
+		if next.IsZero() {
+			//the job won't run again, forget it unless it was replaced in the meantime
+			sched.entriesLock.Lock()
+			if sched.entries[entry.job.ID] == entry {
+				delete(sched.entries, entry.job.ID)
+			}
+			sched.entriesLock.Unlock()
+			return
+		}
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C:
+			go entry.job.Run()
+		case <-entry.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+//changed applies a change to a job on this scheduler and notifies the other controllers
+func (sched *Scheduler) changed(db redis.Conn, id string) {
+	sched.apply(id)
+
+	if _, err := db.Do("PUBLISH", scheduleChangesChannel, id); err != nil {
+		log.Println("Scheduler: failed to publish change of job", id, err)
+	}
+}
+
+//apply arms, rearms or disarms a single job according to what is stored in the schedule hash
+func (sched *Scheduler) apply(id string) {
+	db := sched.pool.Get()
+	defer db.Close()
+
+	//reading under the lock keeps concurrent applies of the same job in order
+	sched.entriesLock.Lock()
+	defer sched.entriesLock.Unlock()
+
+	spec, err := redis.String(db.Do("HGET", hashScheduleKey, id))
+	if err != nil && err != redis.ErrNil {
+		log.Println("Scheduler: failed to load job", id, err)
+		return
+	}
+
+	sched.arm(id, spec)
+}
+
+//arm must be called with entriesLock held, an empty spec disarms the job
+func (sched *Scheduler) arm(id string, spec string) {
+	entry, ok := sched.entries[id]
+	if ok && entry.spec == spec {
+		return
+	}
+
+	if ok {
+		close(entry.stop)
+		delete(sched.entries, id)
+	}
+
+	if spec == "" {
+		return
+	}
+
+	job, err := parseSchedulerJob(id, spec)
+	if err != nil {
+		log.Println("Failed to load scheduled job", id, err)
+		return
+	}
+
+	if !job.Enabled {
+		return
+	}
+
+	job.scheduler = sched
+	entry = &scheduleEntry{
+		job:  job,
+		spec: spec,
+		stop: make(chan struct{}),
+	}
+	sched.entries[id] = entry
+
+	go entry.run(sched)
+}
+
+//load reconciles the armed jobs with the whole schedule hash
+func (sched *Scheduler) load() {
+	db := sched.pool.Get()
+	defer db.Close()
+
+	specs := make(map[string]string)
+
+	var cursor int
+	for {
+		slice, err := redis.Values(db.Do("HSCAN", hashScheduleKey, cursor))
+		if err != nil {
+			log.Println("Failed to load schedule from redis", err)
+			return
+		}
+
+		var fields interface{}
+		if _, err := redis.Scan(slice, &cursor, &fields); err != nil {
+			log.Println(err)
+			return
+		}
+
+		set, _ := redis.StringMap(fields, nil)
+		for key, spec := range set {
+			specs[key] = spec
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	sched.entriesLock.Lock()
+	defer sched.entriesLock.Unlock()
+
+	for id := range sched.entries {
+		if _, ok := specs[id]; !ok {
+			sched.arm(id, "")
+		}
+	}
+
+	for id, spec := range specs {
+		sched.arm(id, spec)
+	}
+}
+
+//watch follows the changes made by the other controllers, resubscribing if the connection drops
+func (sched *Scheduler) watch() {
+	for {
+		sched.follow()
+		time.Sleep(scheduleChangesRetry)
+	}
+}
+
+func (sched *Scheduler) follow() {
+	db := sched.pool.Get()
+	defer db.Close()
+
+	changes := redis.PubSubConn{Conn: db}
+	if err := changes.Subscribe(scheduleChangesChannel); err != nil {
+		log.Println("Scheduler: failed to subscribe to schedule changes", err)
+		return
+	}
+
+	//changes published while we weren't subscribed are lost, catch up with a full reload
+	sched.load()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(scheduleChangesKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				changes.Ping("")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		switch message := changes.Receive().(type) {
+		case redis.Message:
+			sched.apply(string(message.Data))
+		case error:
+			log.Println("Scheduler: lost the schedule changes subscription", message)
+			return
+		}
+	}
+}
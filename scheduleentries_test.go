@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	yearlySpec = `{"type": "cron", "cron": "0 0 0 1 1 *", "cmd": {"cmd": "ping"}, "enabled": true}`
+	dailySpec  = `{"type": "cron", "cron": "0 0 0 * * *", "cmd": {"cmd": "ping"}, "enabled": true}`
+	pausedSpec = `{"type": "cron", "cron": "0 0 0 * * *", "cmd": {"cmd": "ping"}, "enabled": false}`
+)
+
+//armed returns the entry of a job and whether it is armed
+func armed(sched *Scheduler, id string) (*scheduleEntry, bool) {
+	sched.entriesLock.Lock()
+	defer sched.entriesLock.Unlock()
+	return sched.entries[id], sched.entries[id] != nil
+}
+
+func stopped(entry *scheduleEntry) bool {
+	select {
+	case <-entry.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSchedulerApply(t *testing.T) {
+
+	fake := newFakeRedis()
+	sched := NewScheduler(fake.pool(), 0)
+
+	fake.hash(hashScheduleKey)["job"] = yearlySpec
+	sched.apply("job")
+	first, ok := armed(sched, "job")
+	assert.True(t, ok)
+
+	//applying an unchanged job keeps it armed as is
+	sched.apply("job")
+	same, _ := armed(sched, "job")
+	assert.True(t, first == same)
+	assert.False(t, stopped(first))
+
+	//a changed job is rearmed
+	fake.hash(hashScheduleKey)["job"] = dailySpec
+	sched.apply("job")
+	second, ok := armed(sched, "job")
+	assert.True(t, ok)
+	assert.True(t, first != second)
+	assert.True(t, stopped(first))
+
+	//paused and removed jobs are disarmed
+	fake.hash(hashScheduleKey)["job"] = pausedSpec
+	sched.apply("job")
+	_, ok = armed(sched, "job")
+	assert.False(t, ok)
+	assert.True(t, stopped(second))
+
+	fake.hash(hashScheduleKey)["job"] = dailySpec
+	sched.apply("job")
+	third, _ := armed(sched, "job")
+	delete(fake.hashes[hashScheduleKey], "job")
+	sched.apply("job")
+	_, ok = armed(sched, "job")
+	assert.False(t, ok)
+	assert.True(t, stopped(third))
+}
+
+func TestSchedulerLoad(t *testing.T) {
+
+	fake := newFakeRedis()
+	sched := NewScheduler(fake.pool(), 0)
+
+	fake.hash(hashScheduleKey)["kept"] = yearlySpec
+	fake.hash(hashScheduleKey)["gone"] = dailySpec
+	sched.load()
+	kept, _ := armed(sched, "kept")
+	gone, _ := armed(sched, "gone")
+
+	//a reload only touches the jobs that changed
+	delete(fake.hashes[hashScheduleKey], "gone")
+	fake.hash(hashScheduleKey)["new"] = dailySpec
+	sched.load()
+
+	stillKept, ok := armed(sched, "kept")
+	assert.True(t, ok)
+	assert.True(t, kept == stillKept)
+	assert.False(t, stopped(kept))
+
+	_, ok = armed(sched, "gone")
+	assert.False(t, ok)
+	assert.True(t, stopped(gone))
+
+	_, ok = armed(sched, "new")
+	assert.True(t, ok)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+const (
+	scheduleLeaderKey           = "controller.schedule.leader"
+	defaultScheduleLeaseTimeout = 15 * time.Second
+)
+
+//renewLeaseScript extends the lease only if it is still held by the given instance
+var renewLeaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+//leaderPushScript pushes a command only if the lease is still held by the given instance, so a
+//controller that lost its lease without noticing yet can't fire a job the new leader fires too.
+//If a job ID is given, the job is removed from the schedule and nothing is pushed (-1) if it was
+//already gone.
+var leaderPushScript = redis.NewScript(3, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if ARGV[3] ~= "" and redis.call("HDEL", KEYS[3], ARGV[3]) == 0 then
+	return -1
+end
+redis.call("RPUSH", KEYS[2], ARGV[2])
+return 1
+`)
+
+//ScheduleLeadership is the leader election state as reported by scheduler_leader
+type ScheduleLeadership struct {
+	Leader   string `json:"leader"`
+	Instance string `json:"instance"`
+	IsLeader bool   `json:"is_leader"`
+	//LeaseTTL is the time left on the leader's lease in milliseconds
+	LeaseTTL int64 `json:"lease_ttl"`
+}
+
+func newSchedulerInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), uuid.New()[:8])
+}
+
+//IsLeader returns true if this scheduler currently holds the lease and fires jobs
+func (sched *Scheduler) IsLeader() bool {
+	sched.leaderLock.RLock()
+	defer sched.leaderLock.RUnlock()
+	return sched.leader
+}
+
+//lead keeps acquiring or renewing the lease, a standby takes over within 4/3 of the lease
+//timeout after the leader stops renewing it
+func (sched *Scheduler) lead() {
+	for {
+		time.Sleep(sched.leaseTimeout / 3)
+		sched.refreshLease()
+	}
+}
+
+func (sched *Scheduler) refreshLease() {
+	db := sched.pool.Get()
+	defer db.Close()
+
+	lease := int64(sched.leaseTimeout / time.Millisecond)
+
+	renewed, err := redis.Int(renewLeaseScript.Do(db, scheduleLeaderKey, sched.instance, lease))
+	held := err == nil && renewed == 1
+
+	if !held {
+		_, err = redis.String(db.Do("SET", scheduleLeaderKey, sched.instance, "NX", "PX", lease))
+		held = err == nil
+		if err != nil && err != redis.ErrNil {
+			log.Println("Scheduler: failed to acquire leader lease", err)
+		}
+	}
+
+	sched.leaderLock.Lock()
+	defer sched.leaderLock.Unlock()
+
+	if held != sched.leader {
+		if held {
+			log.Println("Scheduler: became the leader as", sched.instance)
+			go sched.catchUp()
+		} else {
+			log.Println("Scheduler: lost the leader lease, standing by as", sched.instance)
+		}
+	}
+	sched.leader = held
+}
+
+//Leader reports which controller instance currently fires the scheduled jobs
+func (sched *Scheduler) Leader(cmd *core.Command) (interface{}, error) {
+	db := sched.pool.Get()
+	defer db.Close()
+
+	leader, err := redis.String(db.Do("GET", scheduleLeaderKey))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	ttl, err := redis.Int64(db.Do("PTTL", scheduleLeaderKey))
+	if err != nil {
+		return nil, err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return &ScheduleLeadership{
+		Leader:   leader,
+		Instance: sched.instance,
+		IsLeader: sched.IsLeader(),
+		LeaseTTL: ttl,
+	}, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerLeaderLease(t *testing.T) {
+
+	fake := newFakeRedis()
+	leaseTimeout := 200 * time.Millisecond
+	leader := NewScheduler(fake.pool(), leaseTimeout)
+	standby := NewScheduler(fake.pool(), leaseTimeout)
+
+	leader.refreshLease()
+	assert.True(t, leader.IsLeader())
+	standby.refreshLease()
+	assert.False(t, standby.IsLeader(), "no takeover while the lease is fresh")
+
+	//the holder renews its lease, which outlives the first lease_timeout
+	time.Sleep(leaseTimeout * 3 / 5)
+	leader.refreshLease()
+	assert.True(t, leader.IsLeader())
+	time.Sleep(leaseTimeout * 3 / 5)
+	standby.refreshLease()
+	assert.False(t, standby.IsLeader())
+	assert.Equal(t, leader.instance, fake.strings[scheduleLeaderKey])
+
+	//once the holder stops renewing, the standby takes over after lease_timeout
+	time.Sleep(leaseTimeout * 6 / 5)
+	standby.refreshLease()
+	assert.True(t, standby.IsLeader())
+	leader.refreshLease()
+	assert.False(t, leader.IsLeader())
+	assert.Equal(t, standby.instance, fake.strings[scheduleLeaderKey])
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	hashScheduleLastFireKey = "controller.schedule.lastfire"
+
+	//misfire policies, what to do with the runs a job missed while no controller was leading
+	misfireSkip = "skip"
+	misfireOnce = "once"
+	misfireAll  = "all"
+
+	defaultMisfireLimit = 10
+)
+
+func validMisfirePolicy(policy string) error {
+	switch policy {
+	case "", misfireSkip, misfireOnce, misfireAll:
+		return nil
+	default:
+		return fmt.Errorf("unknown misfire policy %q, expected %s, %s or %s", policy, misfireSkip, misfireOnce, misfireAll)
+	}
+}
+
+//recordScheduleFire persists the last time a job ran, to find the runs it misses while no controller leads
+func recordScheduleFire(db redis.Conn, id string, at time.Time) {
+	if _, err := db.Do("HSET", hashScheduleLastFireKey, id, at.Unix()); err != nil {
+		log.Println("Failed to record schedule fire time", id, err)
+	}
+}
+
+//missedRuns counts the runs a job should have had after last and before now, up to limit
+func (job *SchedulerJob) missedRuns(last time.Time, now time.Time, limit int) int {
+	schedule, err := job.schedule()
+	if err != nil {
+		return 0
+	}
+
+	missed := 0
+	for next := schedule.Next(last); !next.IsZero() && next.Before(now) && missed < limit; next = schedule.Next(next) {
+		missed++
+	}
+
+	return missed
+}
+
+/*
+catchUp runs the jobs that missed their time while no controller was leading, it is done every
+time this scheduler becomes the leader. One-shot jobs that are past due always run once, cron
+jobs follow their misfire policy:
+	- skip (default): the missed runs are dropped
+	- once: a single run makes up for all the missed ones
+	- all: every missed run is made up for, up to misfire_limit
+*/
+func (sched *Scheduler) catchUp() {
+	db := sched.pool.Get()
+	defer db.Close()
+
+	set, err := redis.StringMap(db.Do("HGETALL", hashScheduleKey))
+	if err != nil {
+		log.Println("Scheduler: failed to load schedule for catch up", err)
+		return
+	}
+
+	lastFires, err := redis.StringMap(db.Do("HGETALL", hashScheduleLastFireKey))
+	if err != nil {
+		log.Println("Scheduler: failed to load last fire times for catch up", err)
+		return
+	}
+
+	now := time.Now()
+	for key, spec := range set {
+		job, err := parseSchedulerJob(key, spec)
+		if err != nil || !job.Enabled {
+			continue
+		}
+		job.scheduler = sched
+
+		if job.Type == scheduleTypeAt {
+			if job.At <= now.Unix() {
+				log.Println("Scheduler: catching up on one-shot job", job.ID)
+				job.Run()
+			}
+			continue
+		}
+
+		lastFire, ok := lastFires[key]
+		if !ok {
+			continue
+		}
+
+		last, err := strconv.ParseInt(lastFire, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		limit := job.MisfireLimit
+		if limit <= 0 {
+			limit = defaultMisfireLimit
+		}
+
+		missed := job.missedRuns(time.Unix(last, 0), now, limit)
+		if missed == 0 {
+			continue
+		}
+
+		runs := 0
+		switch job.Misfire {
+		case misfireOnce:
+			runs = 1
+		case misfireAll:
+			runs = missed
+		}
+
+		log.Println("Scheduler: job", job.ID, "missed", missed, "run(s), policy", job.Misfire, "catching up on", runs)
+		for i := 0; i < runs; i++ {
+			job.Run()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissedRuns(t *testing.T) {
+
+	hourly := &SchedulerJob{Type: scheduleTypeCron, Cron: "0 0 * * * *"}
+	last := time.Date(2016, 1, 1, 10, 30, 0, 0, time.Local)
+
+	assert.Equal(t, 0, hourly.missedRuns(last, last.Add(20*time.Minute), 10))
+	assert.Equal(t, 1, hourly.missedRuns(last, last.Add(40*time.Minute), 10))
+	assert.Equal(t, 3, hourly.missedRuns(last, last.Add(3*time.Hour), 10))
+	assert.Equal(t, 10, hourly.missedRuns(last, last.Add(24*time.Hour), 10))
+
+	broken := &SchedulerJob{Type: scheduleTypeCron, Cron: "not a cron spec"}
+	assert.Equal(t, 0, broken.missedRuns(last, last.Add(24*time.Hour), 10))
+}
+
+func TestResumeSkipsRunsMissedWhilePaused(t *testing.T) {
+
+	fake := newFakeRedis()
+	sched := NewScheduler(fake.pool(), 0)
+	_, err := sched.Add(&core.Command{ID: "job", Data: `{"cron": "0 0 * * * *", "cmd": {"cmd": "ping"}}`})
+	assert.NoError(t, err)
+
+	_, err = sched.Pause(&core.Command{ID: "job"})
+	assert.NoError(t, err)
+
+	paused := time.Now().Add(-24 * time.Hour).Unix()
+	fake.hashes[hashScheduleLastFireKey]["job"] = strconv.FormatInt(paused, 10)
+
+	resumed, err := sched.Resume(&core.Command{ID: "job"})
+	assert.NoError(t, err)
+	assert.Equal(t, true, resumed)
+
+	last, err := strconv.ParseInt(fake.hashes[hashScheduleLastFireKey]["job"], 10, 64)
+	assert.NoError(t, err)
+	assert.True(t, last > paused)
+}
@@ -0,0 +1,137 @@
+// Sealing of command payloads to an Agent's RSA public key so that only that Agent can read them.
+//
+// A random AES-256 key encrypts the payload with GCM, and that key is in turn encrypted to the
+// Agent's public key with RSA-OAEP (SHA-256). The result is a JSON envelope that fits in a
+// command's string Data field.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+)
+
+const sessionKeySize = 32
+
+// The ASN.1 structure of a PKCS#1 RSA public key
+type pkcs1PublicKey struct {
+	N *big.Int
+	E int
+}
+
+type envelope struct {
+	Key   []byte `json:"key"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// Parses a PEM-encoded RSA public key, either in PKIX ("PUBLIC KEY") or PKCS#1 ("RSA PUBLIC KEY") form
+func ParsePublicKey(pemBytes []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found in public key")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		var key pkcs1PublicKey
+		rest, err := asn1.Unmarshal(block.Bytes, &key)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) > 0 {
+			return nil, errors.New("trailing data after PKCS#1 public key")
+		}
+		if key.N == nil || key.N.Sign() <= 0 || key.E <= 0 {
+			return nil, errors.New("malformed PKCS#1 public key")
+		}
+		return &rsa.PublicKey{N: key.N, E: key.E}, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not an RSA key")
+		}
+		return rsaKey, nil
+	default:
+		return nil, errors.New("unsupported public key type " + block.Type)
+	}
+}
+
+// Seals the plaintext to the given public key
+func Seal(key *rsa.PublicKey, plaintext []byte) (string, error) {
+	sessionKey := make([]byte, sessionKeySize)
+	if _, err := io.ReadFull(rand.Reader, sessionKey); err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, sessionKey, nil)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := json.Marshal(&envelope{
+		Key:   wrappedKey,
+		Nonce: nonce,
+		Data:  gcm.Seal(nil, nonce, plaintext, nil),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(sealed), nil
+}
+
+// Opens a payload previously sealed to the public counterpart of the given private key
+func Open(key *rsa.PrivateKey, sealed string) ([]byte, error) {
+	var env envelope
+	if err := json.Unmarshal([]byte(sealed), &env); err != nil {
+		return nil, err
+	}
+
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, env.Key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(env.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("malformed sealed payload nonce")
+	}
+
+	return gcm.Open(nil, env.Nonce, env.Data, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
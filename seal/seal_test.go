@@ -0,0 +1,52 @@
+package seal_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"testing"
+
+	"github.com/amrhassan/agentcontroller2/seal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealAndOpen(t *testing.T) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	pkcs1, err := asn1.Marshal(key.PublicKey)
+	assert.NoError(t, err)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pkcs1})
+
+	publicKey, err := seal.ParsePublicKey(publicPEM)
+	assert.NoError(t, err)
+	assert.Equal(t, key.PublicKey, *publicKey)
+
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	publicKey, err = seal.ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))
+	assert.NoError(t, err)
+	assert.Equal(t, key.PublicKey, *publicKey)
+
+	sealed, err := seal.Seal(publicKey, []byte("top secret"))
+	assert.NoError(t, err)
+	assert.NotContains(t, sealed, "top secret")
+
+	opened, err := seal.Open(key, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "top secret", string(opened))
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	_, err = seal.Open(otherKey, sealed)
+	assert.Error(t, err)
+}
+
+func TestParsePublicKeyRejectsGarbage(t *testing.T) {
+	_, err := seal.ParsePublicKey([]byte("not a key"))
+	assert.Error(t, err)
+}
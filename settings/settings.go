@@ -1,13 +1,15 @@
 package settings
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 
 	"github.com/naoina/toml"
 )
 
-//HTTPBinding defines the address that should be bound on and optional tls certificates
+//HTTPBinding defines the address that should be bound on and optional tls certificates.
+//Certificates, clientCA's and CRL's are reloaded on SIGHUP or when their files change.
 type HTTPBinding struct {
 	Address string
 	TLS     []struct {
@@ -17,6 +19,82 @@ type HTTPBinding struct {
 	ClientCA []struct {
 		Cert string
 	}
+	//ClientCRL are revocation lists issued by the ClientCA's, revoked client certificates are refused
+	ClientCRL []struct {
+		File string
+	}
+}
+
+//ClientIdentity defines how an agent's gid/nid are encoded in its TLS client certificate
+type ClientIdentity struct {
+	//Field is either "CN" for the subject common name or "SAN" for a DNS subject alternative name
+	Field string
+	//Format is a fmt format with two %d verbs for the gid and nid, e.g. "%d-%d"
+	Format string
+}
+
+//HubbleRule allows tunnels to a target through the hubble proxy, empty or "*" fields match anything
+type HubbleRule struct {
+	//Agent is the connecting agent as "gid:nid", or "gid:*" for all the agents of a grid
+	Agent string
+	//Gateway is the name of the hubble agent that opens the tunnel
+	Gateway string
+	//Host is the tunnel target address as seen by the gateway
+	Host  string
+	Ports []int
+}
+
+//StatsRollup decides what is written of the stats of the measurements matching a glob pattern
+type StatsRollup struct {
+	//Measurement is a glob pattern like "*.*.monitor.cpu.*"
+	Measurement string
+	//Forward is "raw" for the points as they come, "rollup" for their min/max/avg/count per window, or "both"
+	Forward string
+	//Window of the rollups in seconds
+	Window int
+}
+
+//AlertRule fires when a field of the measurements matching a glob pattern stays past a threshold
+type AlertRule struct {
+	Name        string
+	Measurement string
+	//Field compared to the threshold, "value" if empty
+	Field string
+	//Op is one of >, >=, <, <=, == or !=
+	Op        string
+	Threshold float64
+	//For is how many seconds the condition must hold before the rule fires
+	For int
+	//Remediation is an optional command dispatched to the offending agent when the rule fires
+	Remediation map[string]interface{}
+}
+
+//LogSink forwards the logs agents post, type is "file", "syslog" or "webhook"
+type LogSink struct {
+	Type string
+	//Levels forwarded to the sink, all of them if empty
+	Levels []int
+	//Path of the file sink, rotated once it grows past MaxSize megabytes, keeping MaxBackups old files
+	Path       string
+	MaxSize    int
+	MaxBackups int
+	//Network (unixgram, unix, udp or tcp) and Address of the syslog sink, like unixgram and /dev/log
+	Network string
+	Address string
+	//Tag is the syslog app name, "agentcontroller" if empty
+	Tag string
+	//URL the webhook sink posts the logs to, with the extra Headers, within Timeout seconds
+	URL     string
+	Headers map[string]string
+	Timeout int
+}
+
+//ScheduledJob is a job kept in the schedule from the configuration, it can't be removed at runtime
+type ScheduledJob struct {
+	ID   string
+	Cron string
+	//Cmd is the command pushed on every run, like the cmd of a scheduler_add
+	Cmd map[string]interface{}
 }
 
 //Settings are the configurable options for the AgentController
@@ -28,6 +106,25 @@ type Settings struct {
 
 	Listen []HTTPBinding
 
+	ClientIdentity ClientIdentity
+
+	Stats struct {
+		//Sink the agent stats are written to, either "influxdb" (default) or "prometheus" which
+		//serves them on /metrics
+		Sink string
+		//BatchSize and FlushInterval in seconds of the background writes to influxdb
+		BatchSize     int
+		FlushInterval int
+		//SpoolSize is how many batches are kept in redis while influxdb is unavailable
+		SpoolSize int
+		//StaleAfter in seconds drops the prometheus series that weren't written for that long,
+		//MaxSeries caps how many of them are kept
+		StaleAfter int
+		MaxSeries  int
+		//Rollup rules, the first one matching a measurement applies, others are written raw
+		Rollup []StatsRollup
+	}
+
 	Influxdb struct {
 		Host     string
 		Db       string
@@ -35,6 +132,25 @@ type Settings struct {
 		Password string
 	}
 
+	Logs struct {
+		//JobSize and AgentSize cap how many log messages are kept per job and per agent
+		JobSize   int
+		AgentSize int
+		//Retention in hours of the logs of a job or agent after its last message
+		Retention int
+		//Sinks the logs are forwarded to, next to redis
+		Sink []LogSink
+	}
+
+	Retention struct {
+		//Results is how many hours the results, queues and logs of a job are kept once it is finished
+		Results int
+		//Joblog caps the joblog list of dispatched commands
+		Joblog int
+		//Archive is a directory finished jobs are written to, as gzipped JSON lines, before they expire
+		Archive string
+	}
+
 	Handlers struct {
 		Binary string
 		Cwd    string
@@ -44,6 +160,39 @@ type Settings struct {
 	Syncthing struct {
 		Port int
 	}
+
+	Hubble struct {
+		//Allow lists the tunnels agents may open, anything else is refused
+		Allow []HubbleRule
+	}
+
+	Scheduler struct {
+		//LeaseTimeout in seconds after which a standby controller takes over firing scheduled jobs
+		//from a leader that stopped renewing its lease
+		LeaseTimeout int
+	}
+
+	//Schedule is reconciled into the schedule at startup, jobs that were removed from it are unscheduled
+	Schedule []ScheduledJob
+
+	//Alert rules evaluated on the stats agents report
+	Alert []AlertRule
+
+	Enrollment struct {
+		//CACert and CAKey sign the client certificates of enrolled agents, enrollment is disabled without them
+		CACert string
+		CAKey  string
+		//ValidityDays of the issued client certificates
+		ValidityDays int
+	}
+
+	Auth struct {
+		//AgentTokens requires agents to present a bearer token issued through agent_token_issue
+		AgentTokens bool
+		//OperatorToken is the bearer token required on the operator routes, /metrics and the job logs, without it
+		//they are only served over loopback
+		OperatorToken string
+	}
 }
 
 //LoadSettingsFromTomlFile does exactly what the name says, it loads a toml in a Settings struct
@@ -58,6 +207,10 @@ func LoadSettingsFromTomlFile(filename string) (settings Settings, err error) {
 		return
 	}
 	err = toml.Unmarshal(buf, &settings)
+	if err != nil {
+		return
+	}
+	err = settings.ClientIdentity.Validate()
 	return
 
 }
@@ -71,3 +224,40 @@ func (httpBinding HTTPBinding) TLSEnabled() bool {
 func (httpBinding HTTPBinding) ClientCertificateRequired() bool {
 	return len(httpBinding.ClientCA) > 0
 }
+
+//Enabled returns true if agent identities should be checked against client certificates
+func (identity ClientIdentity) Enabled() bool {
+	return identity.Format != ""
+}
+
+//Validate checks that the identity field and format are usable
+func (identity ClientIdentity) Validate() error {
+	if !identity.Enabled() {
+		return nil
+	}
+	if identity.Field != "CN" && identity.Field != "SAN" {
+		return fmt.Errorf("clientidentity field must be CN or SAN, not %q", identity.Field)
+	}
+	if _, _, ok := identity.Parse(identity.Name(1, 2)); !ok {
+		return fmt.Errorf("clientidentity format %q must contain exactly a gid and a nid", identity.Format)
+	}
+	return nil
+}
+
+//Name returns the certificate name that identifies the given agent
+func (identity ClientIdentity) Name(gid uint, nid uint) string {
+	return fmt.Sprintf(identity.Format, gid, nid)
+}
+
+//Parse extracts the gid and nid from a certificate name, ok is false if the name doesn't match the format exactly
+func (identity ClientIdentity) Parse(name string) (gid uint, nid uint, ok bool) {
+	if _, err := fmt.Sscanf(name, identity.Format, &gid, &nid); err != nil {
+		return 0, 0, false
+	}
+	return gid, nid, identity.Name(gid, nid) == name
+}
+
+//EnrollmentEnabled returns true if an enrollment CA is configured
+func (settings Settings) EnrollmentEnabled() bool {
+	return settings.Enrollment.CACert != "" && settings.Enrollment.CAKey != ""
+}
@@ -29,3 +29,61 @@ func TestLoadSettingsFromFile(t *testing.T) {
 	}
 
 }
+
+func TestClientIdentity(t *testing.T) {
+
+	identity := settings.ClientIdentity{Field: "CN", Format: "agent-%d-%d"}
+
+	if err := identity.Validate(); err != nil {
+		t.Error("Valid client identity rejected", err)
+	}
+
+	if name := identity.Name(3, 14); name != "agent-3-14" {
+		t.Error("Unexpected identity name", name)
+	}
+
+	gid, nid, ok := identity.Parse("agent-3-14")
+	if !ok || gid != 3 || nid != 14 {
+		t.Error("Failed to parse identity name", gid, nid, ok)
+	}
+
+	if _, _, ok := identity.Parse("agent-3-14.example.com"); ok {
+		t.Error("Name with trailing data should not match")
+	}
+
+	if err := (settings.ClientIdentity{Field: "OU", Format: "%d-%d"}).Validate(); err == nil {
+		t.Error("Unknown identity field accepted")
+	}
+
+	if err := (settings.ClientIdentity{Field: "CN", Format: "%d"}).Validate(); err == nil {
+		t.Error("Identity format without a nid accepted")
+	}
+}
+
+func TestLoadScheduleFromFile(t *testing.T) {
+
+	settingsfile, _ := ioutil.TempFile("", "")
+
+	settingsfile.WriteString("[[schedule]]\n")
+	settingsfile.WriteString("id = \"cleanup\"\n")
+	settingsfile.WriteString("cron = \"0 0 3 * * *\"\n")
+	settingsfile.WriteString("  [schedule.cmd]\n")
+	settingsfile.WriteString("  gid = 1\n")
+	settingsfile.WriteString("  cmd = \"execute\"\n")
+	settingsfile.Close()
+	defer os.Remove(settingsfile.Name())
+
+	settings, err := settings.LoadSettingsFromTomlFile(settingsfile.Name())
+	if err != nil {
+		t.Fatal("Error while loading toml file", err)
+	}
+
+	if len(settings.Schedule) != 1 {
+		t.Fatal("Schedule not loaded from the configuration file", settings.Schedule)
+	}
+
+	job := settings.Schedule[0]
+	if job.ID != "cleanup" || job.Cron != "0 0 3 * * *" || job.Cmd["cmd"] != "execute" {
+		t.Error("Unexpected scheduled job", job)
+	}
+}
@@ -0,0 +1,281 @@
+package stats
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	listStatsSpool = "stats.spool"
+
+	DefaultBatchSize     = 500
+	DefaultFlushInterval = 10 * time.Second
+	DefaultSpoolSize     = 1000
+	DefaultRetries       = 3
+	DefaultBackoff       = time.Second
+)
+
+// How a BufferedSink batches, retries and spools points
+type BufferOptions struct {
+	// Points are flushed once that many are pending, or every FlushInterval
+	BatchSize     int
+	FlushInterval time.Duration
+	// A failed write is retried that many times, waiting Backoff, then twice as long, and so on.
+	// Once it still fails, or while the spool isn't empty, batches are spooled without retries.
+	Retries int
+	Backoff time.Duration
+	// Batches that still can't be written are spooled in redis, up to SpoolSize of them
+	SpoolSize int
+}
+
+func (options *BufferOptions) defaults() {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultBatchSize
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	if options.Retries < 0 {
+		options.Retries = 0
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = DefaultBackoff
+	}
+	if options.SpoolSize <= 0 {
+		options.SpoolSize = DefaultSpoolSize
+	}
+}
+
+// Counters of the points that went through a BufferedSink
+type BufferCounters struct {
+	Written uint64 `json:"written"`
+	Spooled uint64 `json:"spooled"`
+	Dropped uint64 `json:"dropped"`
+	// Points the sink refused, they are dropped rather than retried
+	Rejected uint64 `json:"rejected"`
+}
+
+/*
+Batches the points written by all the agents and writes them to a sink in the background. A write
+that fails is retried with backoff, then spooled in a bounded redis list. From then on, every batch
+is spooled right away until the spool is drained, which is attempted on every flush, so an
+unavailable sink doesn't hold up the buffer. Points are only dropped, and counted, when the spool
+or the in-memory buffer is full, or when the sink refuses them with a PermanentError: such a batch
+is neither retried nor spooled, and doesn't make the sink unavailable.
+*/
+type BufferedSink struct {
+	sink    Sink
+	pool    *redis.Pool
+	options BufferOptions
+
+	lock    sync.Mutex
+	pending []Point
+	flush   chan struct{}
+
+	written  uint64
+	spooled  uint64
+	dropped  uint64
+	rejected uint64
+}
+
+// Starts a BufferedSink in front of sink, a nil pool disables spooling
+func NewBufferedSink(sink Sink, pool *redis.Pool, options BufferOptions) *BufferedSink {
+	options.defaults()
+
+	buffered := &BufferedSink{
+		sink:    sink,
+		pool:    pool,
+		options: options,
+		flush:   make(chan struct{}, 1),
+	}
+
+	go buffered.run()
+
+	return buffered
+}
+
+// Queues the points, they are written later on
+func (buffered *BufferedSink) Write(points []Point) error {
+	buffered.lock.Lock()
+	defer buffered.lock.Unlock()
+
+	buffered.pending = append(buffered.pending, points...)
+
+	//while the sink is retrying, keep at most a few batches in memory
+	if limit := 10 * buffered.options.BatchSize; len(buffered.pending) > limit {
+		over := len(buffered.pending) - limit
+		buffered.pending = append([]Point(nil), buffered.pending[over:]...)
+		buffered.drop(over, "the buffer is full")
+	}
+
+	if len(buffered.pending) >= buffered.options.BatchSize {
+		select {
+		case buffered.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (buffered *BufferedSink) Counters() BufferCounters {
+	return BufferCounters{
+		Written:  atomic.LoadUint64(&buffered.written),
+		Spooled:  atomic.LoadUint64(&buffered.spooled),
+		Dropped:  atomic.LoadUint64(&buffered.dropped),
+		Rejected: atomic.LoadUint64(&buffered.rejected),
+	}
+}
+
+func (buffered *BufferedSink) drop(count int, reason string) {
+	dropped := atomic.AddUint64(&buffered.dropped, uint64(count))
+	log.Println("Stats: dropped", count, "points,", reason, "-", dropped, "dropped so far")
+}
+
+func (buffered *BufferedSink) reject(count int, err error) {
+	rejected := atomic.AddUint64(&buffered.rejected, uint64(count))
+	log.Println("Stats: the sink rejected", count, "points:", err, "-", rejected, "rejected so far")
+}
+
+func (buffered *BufferedSink) run() {
+	ticker := time.NewTicker(buffered.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-buffered.flush:
+		}
+
+		buffered.writePending()
+	}
+}
+
+// Writes the pending points in batches, or spools them all while the sink is unavailable
+func (buffered *BufferedSink) writePending() {
+	//the spool goes first to keep the points in order
+	available := buffered.drain()
+
+	for {
+		buffered.lock.Lock()
+		size := len(buffered.pending)
+		if size > buffered.options.BatchSize {
+			size = buffered.options.BatchSize
+		}
+		batch := buffered.pending[:size]
+		buffered.pending = buffered.pending[size:]
+		more := len(buffered.pending) >= buffered.options.BatchSize || (!available && len(buffered.pending) > 0)
+		buffered.lock.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+
+		if available {
+			available = buffered.write(batch)
+		}
+		if !available {
+			buffered.spool(batch)
+		}
+
+		if !more {
+			return
+		}
+	}
+}
+
+// Writes a batch to the sink, retrying with backoff. Returns false if the sink is unavailable.
+func (buffered *BufferedSink) write(batch []Point) bool {
+	backoff := buffered.options.Backoff
+	for attempt := 0; ; attempt++ {
+		err := buffered.sink.Write(batch)
+		if err == nil {
+			atomic.AddUint64(&buffered.written, uint64(len(batch)))
+			return true
+		}
+		if IsPermanent(err) {
+			buffered.reject(len(batch), err)
+			return true
+		}
+
+		if attempt >= buffered.options.Retries {
+			log.Println("Stats: failed to write", len(batch), "points:", err)
+			return false
+		}
+
+		log.Println("Stats: failed to write", len(batch), "points, retrying in", backoff, ":", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Keeps a batch that couldn't be written in redis, dropping the oldest batches once the spool is full.
+// Batches are spooled in the line protocol, which keeps integer fields apart from float ones.
+func (buffered *BufferedSink) spool(batch []Point) {
+	if buffered.pool == nil {
+		buffered.drop(len(batch), "the sink is unavailable")
+		return
+	}
+
+	dump := FormatLineProtocol(batch)
+
+	db := buffered.pool.Get()
+	defer db.Close()
+
+	length, err := redis.Int(db.Do("RPUSH", listStatsSpool, dump))
+	if err != nil {
+		buffered.drop(len(batch), "the spool is unavailable")
+		return
+	}
+	atomic.AddUint64(&buffered.spooled, uint64(len(batch)))
+
+	for ; length > buffered.options.SpoolSize; length-- {
+		oldest, err := redis.Bytes(db.Do("LPOP", listStatsSpool))
+		if err != nil {
+			return
+		}
+		buffered.drop(bytes.Count(oldest, []byte("\n")), "the spool is full")
+	}
+}
+
+// Writes the spooled batches, oldest first, until the spool is empty or a write fails. Returns false
+// if a write failed, the sink is then considered unavailable. Rejected batches are dropped.
+func (buffered *BufferedSink) drain() bool {
+	if buffered.pool == nil {
+		return true
+	}
+
+	db := buffered.pool.Get()
+	defer db.Close()
+
+	for {
+		//the spool is empty, or redis is down and nothing can be spooled anyway
+		dump, err := redis.Bytes(db.Do("LPOP", listStatsSpool))
+		if err != nil {
+			return true
+		}
+
+		batch, rejected := ParseLineProtocol(dump, time.Nanosecond, time.Now())
+		if len(rejected) > 0 {
+			buffered.drop(len(rejected), "they are malformed in the spool")
+		}
+
+		err = buffered.sink.Write(batch)
+		if IsPermanent(err) {
+			buffered.reject(len(batch), err)
+			continue
+		}
+		if err != nil {
+			//back in front of the spool, the next flush tries again
+			log.Println("Stats: failed to write", len(batch), "spooled points:", err)
+			db.Do("LPUSH", listStatsSpool, dump)
+			return false
+		}
+		atomic.AddUint64(&buffered.written, uint64(len(batch)))
+	}
+}
@@ -0,0 +1,246 @@
+package stats_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+type flakySink struct {
+	lock     sync.Mutex
+	failures int
+	attempts int
+	batches  [][]stats.Point
+}
+
+func (sink *flakySink) Write(points []stats.Point) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	sink.attempts++
+	if sink.failures > 0 {
+		sink.failures--
+		return errors.New("unavailable")
+	}
+	sink.batches = append(sink.batches, points)
+	return nil
+}
+
+// rejectingSink refuses the batches holding a point of the rejected measurement
+type rejectingSink struct {
+	flakySink
+	rejected string
+}
+
+func (sink *rejectingSink) Write(points []stats.Point) error {
+	for _, point := range points {
+		if point.Measurement == sink.rejected {
+			sink.lock.Lock()
+			sink.attempts++
+			sink.lock.Unlock()
+			return &stats.PermanentError{Err: errors.New("unable to parse")}
+		}
+	}
+	return sink.flakySink.Write(points)
+}
+
+func (sink *flakySink) written() [][]stats.Point {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.batches
+}
+
+func (sink *flakySink) recover() {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.failures = 0
+}
+
+func (sink *flakySink) tries() int {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.attempts
+}
+
+// spoolConn is a redis connection that only knows the list commands of the spool
+type spoolConn struct {
+	lock  *sync.Mutex
+	spool *[]string
+}
+
+func (conn spoolConn) Do(command string, args ...interface{}) (interface{}, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	switch command {
+	case "RPUSH":
+		*conn.spool = append(*conn.spool, fmt.Sprintf("%s", args[1]))
+	case "LPUSH":
+		*conn.spool = append([]string{fmt.Sprintf("%s", args[1])}, *conn.spool...)
+	case "LPOP":
+		if len(*conn.spool) == 0 {
+			return nil, nil
+		}
+		oldest := (*conn.spool)[0]
+		*conn.spool = (*conn.spool)[1:]
+		return []byte(oldest), nil
+	default:
+		return nil, fmt.Errorf("unexpected %s", command)
+	}
+	return int64(len(*conn.spool)), nil
+}
+
+func (conn spoolConn) Send(command string, args ...interface{}) error {
+	return errors.New("unexpected send")
+}
+
+func (conn spoolConn) Flush() error {
+	return nil
+}
+
+func (conn spoolConn) Receive() (interface{}, error) {
+	return nil, errors.New("unexpected receive")
+}
+
+func (conn spoolConn) Close() error {
+	return nil
+}
+
+func (conn spoolConn) Err() error {
+	return nil
+}
+
+func spoolPool(spool *[]string) (*redis.Pool, func() int) {
+	lock := &sync.Mutex{}
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		return spoolConn{lock: lock, spool: spool}, nil
+	}}
+	return pool, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(*spool)
+	}
+}
+
+func points(count int) []stats.Point {
+	points := make([]stats.Point, count)
+	for i := range points {
+		points[i] = stats.Point{Measurement: "cpu", Fields: map[string]interface{}{"value": float64(i)}}
+	}
+	return points
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestBufferedSinkBatchesAndRetries(t *testing.T) {
+
+	sink := &flakySink{failures: 2}
+	buffered := stats.NewBufferedSink(sink, nil, stats.BufferOptions{
+		BatchSize:     3,
+		FlushInterval: time.Hour,
+		Retries:       2,
+		Backoff:       time.Millisecond,
+	})
+
+	buffered.Write(points(2))
+	buffered.Write(points(2))
+
+	eventually(t, func() bool { return len(sink.written()) == 1 })
+	assert.Len(t, sink.written()[0], 3)
+	assert.Equal(t, stats.BufferCounters{Written: 3}, buffered.Counters())
+}
+
+func TestBufferedSinkDropsWithoutSpool(t *testing.T) {
+
+	sink := &flakySink{failures: 100}
+	buffered := stats.NewBufferedSink(sink, nil, stats.BufferOptions{
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		Retries:       1,
+		Backoff:       time.Millisecond,
+	})
+
+	buffered.Write(points(2))
+
+	eventually(t, func() bool { return buffered.Counters().Dropped == 2 })
+	assert.Empty(t, sink.written())
+}
+
+func TestBufferedSinkSpoolsWithoutRetries(t *testing.T) {
+
+	var spool []string
+	pool, spooled := spoolPool(&spool)
+
+	sink := &flakySink{failures: 100}
+	buffered := stats.NewBufferedSink(sink, pool, stats.BufferOptions{
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		Retries:       1,
+		Backoff:       time.Millisecond,
+	})
+
+	//only the first batch is retried, the others go to the spool right away
+	buffered.Write(points(7))
+	eventually(t, func() bool { return spooled() == 4 })
+	assert.Equal(t, 2, sink.tries())
+	assert.Equal(t, stats.BufferCounters{Spooled: 7}, buffered.Counters())
+
+	//while the spool isn't empty, new batches are spooled after a single attempt to drain it
+	buffered.Write(points(2))
+	eventually(t, func() bool { return spooled() == 5 })
+	assert.Equal(t, 3, sink.tries())
+
+	//once the sink is back the spool is written first, oldest first
+	sink.recover()
+	buffered.Write(points(2))
+	eventually(t, func() bool { return len(sink.written()) == 6 })
+	assert.Equal(t, 0, spooled())
+	assert.Len(t, sink.written()[0], 2)
+	assert.Len(t, sink.written()[3], 1)
+	assert.Equal(t, stats.BufferCounters{Written: 11, Spooled: 9}, buffered.Counters())
+}
+
+func TestBufferedSinkDropsRejectedBatches(t *testing.T) {
+
+	var spool []string
+	pool, spooled := spoolPool(&spool)
+
+	sink := &rejectingSink{rejected: "malformed"}
+	buffered := stats.NewBufferedSink(sink, pool, stats.BufferOptions{
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		Retries:       3,
+		Backoff:       time.Millisecond,
+	})
+
+	//the rejected batch is tried once, the next ones are still written
+	rejected := points(2)
+	rejected[1].Measurement = "malformed"
+	buffered.Write(rejected)
+	buffered.Write(points(4))
+	eventually(t, func() bool { return len(sink.written()) == 2 })
+	assert.Equal(t, 3, sink.tries())
+	assert.Equal(t, 0, spooled())
+	assert.Equal(t, stats.BufferCounters{Written: 4, Rejected: 2}, buffered.Counters())
+
+	//a rejected batch in the spool doesn't hold up the ones after it
+	spool = append(spool, string(stats.FormatLineProtocol(rejected)), string(stats.FormatLineProtocol(points(1))))
+	buffered.Write(points(2))
+	eventually(t, func() bool { return len(sink.written()) == 4 })
+	assert.Equal(t, 0, spooled())
+	assert.Len(t, sink.written()[2], 1)
+	assert.Equal(t, stats.BufferCounters{Written: 7, Rejected: 4}, buffered.Counters())
+}
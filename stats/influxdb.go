@@ -0,0 +1,74 @@
+package stats
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	influxdb "github.com/influxdb/influxdb/client"
+)
+
+/*
+The errors influxdb answers when it can't store points for now. The client only hands over the body
+of an error answer, not its status, so any other answer is taken as a refusal of the points, like a
+parse error or a field type conflict.
+*/
+var influxTransientErrors = []string{"timeout", "write failed", "partial write"}
+
+// Writes stats to an InfluxDB database, one measurement per stat key
+type InfluxDBSink struct {
+	client   *influxdb.Client
+	database string
+}
+
+func NewInfluxDBSink(host string, database string, user string, password string) (*InfluxDBSink, error) {
+	u, err := url.Parse(fmt.Sprintf("http://%s", host))
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := influxdb.NewClient(influxdb.Config{
+		Username: user,
+		Password: password,
+		URL:      *u,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &InfluxDBSink{client: client, database: database}, nil
+}
+
+func (sink *InfluxDBSink) Write(points []Point) error {
+	batch := make([]influxdb.Point, 0, len(points))
+	for _, point := range points {
+		batch = append(batch, influxdb.Point{
+			Measurement: point.Measurement,
+			Time:        point.Time,
+			Tags:        point.Tags,
+			Fields:      point.Fields,
+		})
+	}
+
+	response, err := sink.client.Write(influxdb.BatchPoints{
+		Points:          batch,
+		Database:        sink.database,
+		RetentionPolicy: "default",
+	})
+
+	//without a response influxdb couldn't be reached at all
+	if err != nil && response != nil && !influxTransient(err) {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+func influxTransient(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, transient := range influxTransientErrors {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+	return false
+}
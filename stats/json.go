@@ -0,0 +1,153 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// A point in the JSON format with explicit tags and fields, time is in unix seconds
+type jsonPoint struct {
+	Measurement string                 `json:"measurement"`
+	Time        float64                `json:"time"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+}
+
+// A batch in the legacy format, series are [key, value] pairs
+type seriesBatch struct {
+	Timestamp int64           `json:"timestamp"`
+	Series    [][]interface{} `json:"series"`
+}
+
+/*
+Parses a JSON array of points, each element is either a legacy batch
+
+	{"timestamp": 1445000000, "series": [["gid.nid.cmd.domain.name.measurement", 42], ...]}
+
+or a point with explicit tags and fields, which is at now when it has no time
+
+	{"measurement": "cpu", "time": 1445000000, "tags": {"core": "0"}, "fields": {"usage": 42}}
+
+An error is returned if the body isn't a JSON array, invalid elements are rejected without
+affecting the others.
+*/
+func ParseJSON(content []byte, now time.Time) ([]Point, []Rejected, error) {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(content, &elements); err != nil {
+		return nil, nil, err
+	}
+
+	var points []Point
+	var rejected []Rejected
+
+	for _, element := range elements {
+		var kind map[string]json.RawMessage
+		if err := json.Unmarshal(element, &kind); err != nil {
+			rejected = append(rejected, Rejected{Input: string(element), Error: err.Error()})
+			continue
+		}
+
+		if _, ok := kind["series"]; ok {
+			batch, batchRejected := parseSeriesBatch(element)
+			points = append(points, batch...)
+			rejected = append(rejected, batchRejected...)
+			continue
+		}
+
+		point, err := parseJSONPoint(element, now)
+		if err != nil {
+			rejected = append(rejected, Rejected{Input: string(element), Error: err.Error()})
+			continue
+		}
+		points = append(points, point)
+	}
+
+	return points, rejected, nil
+}
+
+func parseSeriesBatch(element json.RawMessage) ([]Point, []Rejected) {
+	var batch seriesBatch
+	if err := json.Unmarshal(element, &batch); err != nil {
+		return nil, []Rejected{{Input: string(element), Error: err.Error()}}
+	}
+
+	var points []Point
+	var rejected []Rejected
+
+	for _, series := range batch.Series {
+		point, err := parseSeries(series, time.Unix(batch.Timestamp, 0))
+		if err != nil {
+			input, _ := json.Marshal(series)
+			rejected = append(rejected, Rejected{Input: string(input), Error: err.Error()})
+			continue
+		}
+		points = append(points, point)
+	}
+
+	return points, rejected
+}
+
+func parseSeries(series []interface{}, at time.Time) (Point, error) {
+	if len(series) != 2 {
+		return Point{}, errors.New("expected a [key, value] pair")
+	}
+
+	//key is formated as gid.nid.cmd.domain.name.[measuerment] (6 parts)
+	key, ok := series[0].(string)
+	if !ok || key == "" {
+		return Point{}, errors.New("key must be a non empty string")
+	}
+
+	value, ok := series[1].(float64)
+	if !ok {
+		return Point{}, fmt.Errorf("value must be a number, not %v", series[1])
+	}
+
+	return Point{
+		Measurement: key,
+		Time:        at,
+		Tags:        KeyTags(key),
+		Fields:      map[string]interface{}{ValueField: value},
+	}, nil
+}
+
+func parseJSONPoint(element json.RawMessage, now time.Time) (Point, error) {
+	var parsed jsonPoint
+	if err := json.Unmarshal(element, &parsed); err != nil {
+		return Point{}, err
+	}
+
+	if parsed.Measurement == "" {
+		return Point{}, errors.New("missing measurement")
+	}
+	if len(parsed.Fields) == 0 {
+		return Point{}, errors.New("a point needs at least one field")
+	}
+
+	for key, value := range parsed.Fields {
+		switch value.(type) {
+		case float64, string, bool:
+		default:
+			return Point{}, fmt.Errorf("field %q must be a number, string or boolean", key)
+		}
+	}
+
+	point := Point{
+		Measurement: parsed.Measurement,
+		Time:        now,
+		Tags:        parsed.Tags,
+		Fields:      parsed.Fields,
+	}
+	if point.Tags == nil {
+		point.Tags = make(map[string]string)
+	}
+	if parsed.Time != 0 {
+		seconds, fraction := math.Modf(parsed.Time)
+		point.Time = time.Unix(int64(seconds), int64(fraction*float64(time.Second)))
+	}
+
+	return point, nil
+}
@@ -0,0 +1,43 @@
+package stats_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJSON(t *testing.T) {
+
+	now := time.Unix(100, 0)
+	content := []byte(`[
+		{"timestamp": 1445000000, "series": [["1.2.monitor.cpu.percent.avg", 42], ["1.2.monitor.cpu.state", "up"]]},
+		{"measurement": "temperature", "tags": {"sensor": "a"}, "fields": {"celsius": 21.5, "ok": true}},
+		{"measurement": "temperature", "fields": {}},
+		{"measurement": "temperature", "fields": {"celsius": [1, 2]}}
+	]`)
+
+	points, rejected, err := stats.ParseJSON(content, now)
+	assert.NoError(t, err)
+
+	assert.Len(t, points, 2)
+	assert.Equal(t, stats.Point{
+		Measurement: "1.2.monitor.cpu.percent.avg",
+		Time:        time.Unix(1445000000, 0),
+		Tags:        stats.KeyTags("1.2.monitor.cpu.percent.avg"),
+		Fields:      map[string]interface{}{"value": 42.0},
+	}, points[0])
+	assert.Equal(t, stats.Point{
+		Measurement: "temperature",
+		Time:        now,
+		Tags:        map[string]string{"sensor": "a"},
+		Fields:      map[string]interface{}{"celsius": 21.5, "ok": true},
+	}, points[1])
+
+	assert.Len(t, rejected, 3)
+	assert.Equal(t, `["1.2.monitor.cpu.state","up"]`, rejected[0].Input)
+
+	_, _, err = stats.ParseJSON([]byte(`{"not": "an array"}`), now)
+	assert.Error(t, err)
+}
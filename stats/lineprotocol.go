@@ -0,0 +1,248 @@
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Newlines are escaped everywhere as they would split a point in two
+var (
+	measurementEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, ` `, `\ `, "\n", `\n`, "\r", `\r`)
+	tagEscaper         = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`, "\r", `\r`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+)
+
+// A point, or a line, that couldn't be accepted
+type Rejected struct {
+	// Line of the rejected point in a line protocol body, 0 for JSON bodies
+	Line  int    `json:"line,omitempty"`
+	Input string `json:"input"`
+	Error string `json:"error"`
+}
+
+/*
+Parses points in the InfluxDB line protocol, one per line:
+
+	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+
+Timestamps are integers in the given precision, points without one are at now. Integer fields end
+with an i, strings are double quoted, booleans are t, true, f or false in any case. A backslash
+escapes the next character, \n and \r stand for newlines. Empty lines and lines starting with #
+are skipped, invalid lines are rejected without affecting the others.
+*/
+func ParseLineProtocol(content []byte, precision time.Duration, now time.Time) ([]Point, []Rejected) {
+	var points []Point
+	var rejected []Rejected
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		point, err := parseLine(line, precision, now)
+		if err != nil {
+			rejected = append(rejected, Rejected{Line: i + 1, Input: line, Error: err.Error()})
+			continue
+		}
+		points = append(points, point)
+	}
+
+	return points, rejected
+}
+
+func parseLine(line string, precision time.Duration, now time.Time) (Point, error) {
+	sections, err := splitUnescaped(line, ' ', true)
+	if err != nil {
+		return Point{}, err
+	}
+	if len(sections) < 2 || len(sections) > 3 {
+		return Point{}, errors.New("expected a measurement, fields and an optional timestamp")
+	}
+
+	series, err := splitUnescaped(sections[0], ',', false)
+	if err != nil {
+		return Point{}, err
+	}
+
+	point := Point{
+		Measurement: unescape(series[0]),
+		Time:        now,
+		Tags:        make(map[string]string),
+		Fields:      make(map[string]interface{}),
+	}
+	if point.Measurement == "" {
+		return Point{}, errors.New("missing measurement")
+	}
+
+	for _, tag := range series[1:] {
+		key, value, err := splitPair(tag)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid tag %q: %v", tag, err)
+		}
+		point.Tags[key] = unescape(value)
+	}
+
+	fields, err := splitUnescaped(sections[1], ',', true)
+	if err != nil {
+		return Point{}, err
+	}
+	for _, field := range fields {
+		key, raw, err := splitPair(field)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid field %q: %v", field, err)
+		}
+		value, err := parseFieldValue(raw)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid field %q: %v", key, err)
+		}
+		point.Fields[key] = value
+	}
+
+	if len(sections) == 3 {
+		timestamp, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		point.Time = time.Unix(0, timestamp*int64(precision))
+	}
+
+	return point, nil
+}
+
+// Splits on the separator when it isn't escaped with a backslash, or quoted if quotes is set
+func splitUnescaped(text string, separator byte, quotes bool) ([]string, error) {
+	var parts []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\':
+			i++
+		case text[i] == '"' && quotes:
+			quoted = !quoted
+		case text[i] == separator && !quoted:
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated string")
+	}
+	return append(parts, text[start:]), nil
+}
+
+func splitPair(pair string) (string, string, error) {
+	parts, _ := splitUnescaped(pair, '=', true)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("expected key=value")
+	}
+	return unescape(parts[0]), parts[1], nil
+}
+
+func unescape(text string) string {
+	if !strings.Contains(text, `\`) {
+		return text
+	}
+	var unescaped bytes.Buffer
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			i++
+			switch text[i] {
+			case 'n':
+				unescaped.WriteByte('\n')
+				continue
+			case 'r':
+				unescaped.WriteByte('\r')
+				continue
+			}
+		}
+		unescaped.WriteByte(text[i])
+	}
+	return unescaped.String()
+}
+
+func parseFieldValue(raw string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+			return nil, errors.New("unterminated string")
+		}
+		return unescape(raw[1 : len(raw)-1]), nil
+	case strings.HasSuffix(raw, "i"):
+		return strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+	}
+
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+
+	//influxdb can't store NaN nor infinities, they would get the whole batch refused
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("%q is not a number, string or boolean", raw)
+	}
+	return value, nil
+}
+
+// Formats points in the line protocol with nanosecond timestamps, tags and fields sorted by key
+func FormatLineProtocol(points []Point) []byte {
+	var out bytes.Buffer
+	for _, point := range points {
+		out.WriteString(measurementEscaper.Replace(point.Measurement))
+
+		for _, key := range sortedKeys(point.Tags) {
+			out.WriteString("," + tagEscaper.Replace(key) + "=" + tagEscaper.Replace(point.Tags[key]))
+		}
+
+		fields := make([]string, 0, len(point.Fields))
+		for key := range point.Fields {
+			fields = append(fields, key)
+		}
+		sort.Strings(fields)
+		for i, key := range fields {
+			if i == 0 {
+				out.WriteByte(' ')
+			} else {
+				out.WriteByte(',')
+			}
+			out.WriteString(tagEscaper.Replace(key) + "=" + formatFieldValue(point.Fields[key]))
+		}
+
+		out.WriteString(" " + strconv.FormatInt(point.Time.UnixNano(), 10) + "\n")
+	}
+	return out.Bytes()
+}
+
+func formatFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
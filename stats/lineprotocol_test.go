@@ -0,0 +1,106 @@
+package stats_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+
+	now := time.Unix(100, 0)
+	content := []byte("# comment\n" +
+		"cpu,core=0,host=node\\ 1 usage=42.5,count=3i,up=t,state=\"ok, \\\"really\\\"\" 1445000000\n" +
+		"\n" +
+		"disk free=7\n" +
+		"broken\n" +
+		"mem used=lots\n")
+
+	points, rejected := stats.ParseLineProtocol(content, time.Second, now)
+
+	assert.Len(t, points, 2)
+	assert.Equal(t, stats.Point{
+		Measurement: "cpu",
+		Time:        time.Unix(1445000000, 0),
+		Tags:        map[string]string{"core": "0", "host": "node 1"},
+		Fields: map[string]interface{}{
+			"usage": 42.5,
+			"count": int64(3),
+			"up":    true,
+			"state": `ok, "really"`,
+		},
+	}, points[0])
+	assert.Equal(t, "disk", points[1].Measurement)
+	assert.Equal(t, now, points[1].Time)
+
+	assert.Len(t, rejected, 2)
+	assert.Equal(t, 5, rejected[0].Line)
+	assert.Equal(t, "broken", rejected[0].Input)
+	assert.Equal(t, 6, rejected[1].Line)
+}
+
+func TestParseLineProtocolFieldValues(t *testing.T) {
+
+	for _, test := range []struct {
+		raw   string
+		value interface{}
+	}{
+		{"1.5", 1.5},
+		{"-2e3", -2000.0},
+		{"7i", int64(7)},
+		{"TRUE", true},
+		{"f", false},
+		{`"text"`, "text"},
+		{"NaN", nil},
+		{"nan", nil},
+		{"Inf", nil},
+		{"+Inf", nil},
+		{"-inf", nil},
+		{"infinity", nil},
+		{"1e400", nil},
+		{"7.5i", nil},
+		{`"open`, nil},
+	} {
+		points, rejected := stats.ParseLineProtocol([]byte("m value="+test.raw), time.Second, time.Now())
+		if test.value == nil {
+			assert.Empty(t, points, test.raw)
+			assert.Len(t, rejected, 1, test.raw)
+			continue
+		}
+		if assert.Len(t, points, 1, test.raw) {
+			assert.Equal(t, test.value, points[0].Fields["value"], test.raw)
+		}
+	}
+}
+
+func TestFormatLineProtocolRoundTrip(t *testing.T) {
+
+	points := []stats.Point{{
+		Measurement: "net io",
+		Time:        time.Unix(1445000000, 123),
+		Tags:        map[string]string{"iface": "eth,0", "host": "two\nlines\r", "path": `C:\new`},
+		Fields: map[string]interface{}{
+			"bytes": int64(1024),
+			"rate":  0.5,
+			"note":  `say "hi"`,
+			"log":   "first\nsecond\\n",
+			"up":    false,
+		},
+	}, {
+		Measurement: "line\nbreak",
+		Time:        time.Unix(1445000001, 0),
+		Tags:        map[string]string{},
+		Fields:      map[string]interface{}{"value": 1.0},
+	}}
+
+	dump := stats.FormatLineProtocol(points)
+	assert.Equal(t, 2, strings.Count(string(dump), "\n"))
+
+	parsed, rejected := stats.ParseLineProtocol(dump, time.Nanosecond, time.Now())
+
+	assert.Empty(t, rejected)
+	assert.Equal(t, points, parsed)
+}
@@ -0,0 +1,199 @@
+package stats
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The name of the metric all the agent stats are exposed as
+	PrometheusMetric = "agent_stat"
+
+	DefaultStaleAfter = 10 * time.Minute
+	DefaultMaxSeries  = 100000
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// How long a PrometheusSink keeps series around, and how many of them
+type PrometheusOptions struct {
+	// Series that weren't written for that long are no longer exposed, like agents that went away
+	StaleAfter time.Duration
+	// New series are refused once that many are exposed
+	MaxSeries int
+}
+
+func (options *PrometheusOptions) defaults() {
+	if options.StaleAfter <= 0 {
+		options.StaleAfter = DefaultStaleAfter
+	}
+	if options.MaxSeries <= 0 {
+		options.MaxSeries = DefaultMaxSeries
+	}
+}
+
+type prometheusSeries struct {
+	value   float64
+	written time.Time
+}
+
+// Keeps the latest value of every stat and serves them in the Prometheus text format
+type PrometheusSink struct {
+	options PrometheusOptions
+
+	lock   sync.RWMutex
+	series map[string]*prometheusSeries
+}
+
+func NewPrometheusSink(options PrometheusOptions) *PrometheusSink {
+	options.defaults()
+	return &PrometheusSink{options: options, series: make(map[string]*prometheusSeries)}
+}
+
+/*
+Series are identified by their labels, the last point written wins. Every numeric or boolean field
+is a series, labeled with the point tags, its measurement unless a tag is named so, and its field
+name unless it's the legacy value field. String fields aren't exposed. New series beyond MaxSeries
+are refused until stale ones expire.
+*/
+func (sink *PrometheusSink) Write(points []Point) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	now := time.Now()
+	refused := 0
+	for _, point := range points {
+		for field, value := range point.Fields {
+			var number float64
+			switch v := value.(type) {
+			case float64:
+				number = v
+			case int64:
+				number = float64(v)
+			case bool:
+				if v {
+					number = 1
+				}
+			default:
+				continue
+			}
+
+			key := labels(point, field)
+			if series, ok := sink.series[key]; ok {
+				series.value, series.written = number, now
+				continue
+			}
+
+			if len(sink.series) >= sink.options.MaxSeries {
+				sink.expire(now)
+			}
+			if len(sink.series) >= sink.options.MaxSeries {
+				refused++
+				continue
+			}
+			sink.series[key] = &prometheusSeries{value: number, written: now}
+		}
+	}
+
+	if refused > 0 {
+		log.Println("Stats: refused", refused, "new series, the prometheus sink holds", sink.options.MaxSeries, "already")
+	}
+
+	return nil
+}
+
+// Forgets the series that weren't written for StaleAfter, the lock must be held
+func (sink *PrometheusSink) expire(now time.Time) {
+	for key, series := range sink.series {
+		if now.Sub(series.written) > sink.options.StaleAfter {
+			delete(sink.series, key)
+		}
+	}
+}
+
+func (sink *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	sink.Expose(w)
+}
+
+// Writes the latest value of every stat in the Prometheus text format
+func (sink *PrometheusSink) Expose(w io.Writer) error {
+	sink.lock.Lock()
+	sink.expire(time.Now())
+	values := make(map[string]float64, len(sink.series))
+	series := make([]string, 0, len(sink.series))
+	for labels, stored := range sink.series {
+		values[labels] = stored.value
+		series = append(series, labels)
+	}
+	sink.lock.Unlock()
+
+	sort.Strings(series)
+
+	out := bufio.NewWriter(w)
+	out.WriteString("# HELP " + PrometheusMetric + " Latest value of the stats reported by the agents.\n")
+	out.WriteString("# TYPE " + PrometheusMetric + " gauge\n")
+	for _, labels := range series {
+		out.WriteString(PrometheusMetric + labels + " " + strconv.FormatFloat(values[labels], 'g', -1, 64) + "\n")
+	}
+	return out.Flush()
+}
+
+/*
+Formats the labels of a series, the legacy tags come first in their order then the others sorted.
+Tags whose names aren't valid label names are renamed, when that collides with another tag the one
+already named so wins, then the first one in sorted order.
+*/
+func labels(point Point, field string) string {
+	tags := make(map[string]string, len(point.Tags)+2)
+	var renamed []string
+	for key, value := range point.Tags {
+		if labelName(key) == key {
+			tags[key] = value
+		} else {
+			renamed = append(renamed, key)
+		}
+	}
+	sort.Strings(renamed)
+	for _, key := range renamed {
+		if _, taken := tags[labelName(key)]; !taken {
+			tags[labelName(key)] = point.Tags[key]
+		}
+	}
+	if _, ok := tags["measurement"]; !ok {
+		tags["measurement"] = point.Measurement
+	}
+	if field != ValueField {
+		tags["field"] = field
+	}
+
+	pairs := make([]string, 0, len(tags))
+	for _, tag := range Tags {
+		if value, ok := tags[tag]; ok {
+			pairs = append(pairs, tag+`="`+labelEscaper.Replace(value)+`"`)
+			delete(tags, tag)
+		}
+	}
+	for _, tag := range sortedKeys(tags) {
+		pairs = append(pairs, tag+`="`+labelEscaper.Replace(tags[tag])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Replaces the characters Prometheus doesn't allow in label names with underscores
+func labelName(tag string) string {
+	name := []byte(tag)
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
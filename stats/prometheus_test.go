@@ -0,0 +1,80 @@
+package stats_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusSinkKeepsLatestValue(t *testing.T) {
+
+	sink := stats.NewPrometheusSink(stats.PrometheusOptions{})
+
+	key := "1.2.monitor.cpu.percent.avg"
+	assert.NoError(t, sink.Write([]stats.Point{
+		{Measurement: key, Time: time.Unix(10, 0), Tags: stats.KeyTags(key), Fields: map[string]interface{}{"value": 40.0}},
+		{Measurement: key, Time: time.Unix(20, 0), Tags: stats.KeyTags(key), Fields: map[string]interface{}{"value": 42.5}},
+	}))
+
+	quoted := `1.2.monitor.disk.name."sda".free`
+	assert.NoError(t, sink.Write([]stats.Point{
+		{Measurement: quoted, Time: time.Unix(20, 0), Tags: stats.KeyTags(quoted), Fields: map[string]interface{}{"value": 7.0}},
+	}))
+
+	request, err := http.NewRequest("GET", "/metrics", nil)
+	assert.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	sink.ServeHTTP(recorder, request)
+
+	assert.Equal(t, "# HELP agent_stat Latest value of the stats reported by the agents.\n"+
+		"# TYPE agent_stat gauge\n"+
+		`agent_stat{gid="1",nid="2",command="monitor",domain="cpu",name="percent",measurement="avg"} 42.5`+"\n"+
+		`agent_stat{gid="1",nid="2",command="monitor",domain="disk",name="name",measurement="\"sda\".free"} 7`+"\n",
+		recorder.Body.String())
+}
+
+func expose(sink *stats.PrometheusSink) string {
+	var out bytes.Buffer
+	sink.Expose(&out)
+	return out.String()
+}
+
+func TestPrometheusSinkExpiresAndCapsSeries(t *testing.T) {
+
+	sink := stats.NewPrometheusSink(stats.PrometheusOptions{StaleAfter: 50 * time.Millisecond, MaxSeries: 2})
+
+	point := func(name string) stats.Point {
+		return stats.Point{Measurement: name, Tags: map[string]string{}, Fields: map[string]interface{}{"value": 1.0}}
+	}
+
+	sink.Write([]stats.Point{point("first"), point("second"), point("third")})
+	assert.Contains(t, expose(sink), `measurement="first"`)
+	assert.Contains(t, expose(sink), `measurement="second"`)
+	assert.NotContains(t, expose(sink), `measurement="third"`)
+
+	//once the others went stale, there is room again
+	time.Sleep(60 * time.Millisecond)
+	sink.Write([]stats.Point{point("second"), point("third")})
+	assert.NotContains(t, expose(sink), `measurement="first"`)
+	assert.Contains(t, expose(sink), `measurement="second"`)
+	assert.Contains(t, expose(sink), `measurement="third"`)
+}
+
+func TestPrometheusSinkLabelCollisions(t *testing.T) {
+
+	//the tag named like the label wins over the ones renamed to it, then the first in sorted order
+	for i := 0; i < 10; i++ {
+		sink := stats.NewPrometheusSink(stats.PrometheusOptions{})
+		sink.Write([]stats.Point{{
+			Measurement: "cpu",
+			Tags:        map[string]string{"a.b": "dot", "a-b": "dash", "a_b": "underscore", "c.d": "dot", "c-d": "dash"},
+			Fields:      map[string]interface{}{"value": 1.0},
+		}})
+		assert.Contains(t, expose(sink), `{measurement="cpu",a_b="underscore",c_d="dash"} 1`)
+	}
+}
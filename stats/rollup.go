@@ -0,0 +1,267 @@
+package stats
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ForwardRaw    = "raw"
+	ForwardRollup = "rollup"
+	ForwardBoth   = "both"
+
+	// The tag rollup points get, with their window as value
+	RollupTag = "rollup"
+
+	// Points may arrive that late after the end of their window and still be rolled up
+	RollupGrace = 10 * time.Second
+)
+
+// Decides what happens to the points of the measurements matching a glob pattern
+type RollupRule struct {
+	Measurement string
+	// Forward is raw, rollup or both
+	Forward string
+	Window  time.Duration
+}
+
+func (rule *RollupRule) validate() error {
+	if _, err := path.Match(rule.Measurement, ""); err != nil {
+		return fmt.Errorf("invalid measurement pattern %q: %v", rule.Measurement, err)
+	}
+
+	switch rule.Forward {
+	case ForwardRaw:
+		return nil
+	case ForwardRollup, ForwardBoth:
+		if rule.Window <= 0 {
+			return fmt.Errorf("rollup of %q needs a positive window", rule.Measurement)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown forward %q for %q, expected %s, %s or %s",
+			rule.Forward, rule.Measurement, ForwardRaw, ForwardRollup, ForwardBoth)
+	}
+}
+
+type aggregate struct {
+	min   float64
+	max   float64
+	sum   float64
+	count int
+}
+
+// The points of a series in a single window
+type bucket struct {
+	measurement string
+	tags        map[string]string
+	start       time.Time
+	end         time.Time
+	fields      map[string]*aggregate
+}
+
+/*
+Aggregates the points of the measurements matching a rule in windows, and writes the min, max, avg
+and count of their numeric fields to the sink once a window ends. Rolled up points are at the start
+of their window, tagged with it, and have a <field>_min, <field>_max, <field>_avg and <field>_count
+field for every field, or min, max, avg and count for the legacy value field. Points that don't
+match any rule are forwarded raw, the first matching rule wins.
+*/
+type Rollup struct {
+	sink  Sink
+	rules []RollupRule
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+// Starts rolling up points in front of sink
+func NewRollup(sink Sink, rules []RollupRule) (*Rollup, error) {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	rollup := &Rollup{
+		sink:    sink,
+		rules:   rules,
+		buckets: make(map[string]*bucket),
+	}
+
+	go rollup.run()
+
+	return rollup, nil
+}
+
+func (rollup *Rollup) run() {
+	for now := range time.Tick(time.Second) {
+		if err := rollup.Flush(now); err != nil {
+			log.Println("Stats: failed to write rollups", err)
+		}
+	}
+}
+
+func (rollup *Rollup) rule(measurement string) *RollupRule {
+	for i, rule := range rollup.rules {
+		if matched, _ := path.Match(rule.Measurement, measurement); matched {
+			return &rollup.rules[i]
+		}
+	}
+	return nil
+}
+
+func (rollup *Rollup) Write(points []Point) error {
+	raw := make([]Point, 0, len(points))
+	now := time.Now()
+
+	rollup.lock.Lock()
+	for _, point := range points {
+		rule := rollup.rule(point.Measurement)
+		if rule == nil || rule.Forward != ForwardRollup {
+			raw = append(raw, point)
+		}
+		if rule != nil && rule.Forward != ForwardRaw {
+			rollup.add(point, rule.Window, now)
+		}
+	}
+	rollup.lock.Unlock()
+
+	if len(raw) == 0 {
+		return nil
+	}
+	return rollup.sink.Write(raw)
+}
+
+// Adds a point to the bucket of its window, must be called with the lock held
+func (rollup *Rollup) add(point Point, window time.Duration, now time.Time) {
+	start := point.Time.Truncate(window)
+	if start.Add(window + RollupGrace).Before(now) {
+		log.Println("Stats: not rolling up", point.Measurement, "its window ended at", start.Add(window))
+		return
+	}
+
+	key := seriesKey(point, start)
+	current, ok := rollup.buckets[key]
+	if !ok {
+		current = &bucket{
+			measurement: point.Measurement,
+			tags:        point.Tags,
+			start:       start,
+			end:         start.Add(window),
+			fields:      make(map[string]*aggregate),
+		}
+		rollup.buckets[key] = current
+	}
+
+	for field, value := range point.Fields {
+		var number float64
+		switch v := value.(type) {
+		case float64:
+			number = v
+		case int64:
+			number = float64(v)
+		default:
+			continue
+		}
+
+		aggregated, ok := current.fields[field]
+		if !ok {
+			current.fields[field] = &aggregate{min: number, max: number, sum: number, count: 1}
+			continue
+		}
+		if number < aggregated.min {
+			aggregated.min = number
+		}
+		if number > aggregated.max {
+			aggregated.max = number
+		}
+		aggregated.sum += number
+		aggregated.count++
+	}
+}
+
+func seriesKey(point Point, start time.Time) string {
+	parts := []string{point.Measurement}
+	for _, key := range sortedKeys(point.Tags) {
+		parts = append(parts, key+"="+point.Tags[key])
+	}
+	parts = append(parts, fmt.Sprint(start.UnixNano()))
+	return strings.Join(parts, "\xff")
+}
+
+// Writes the rollups of the windows that ended at least RollupGrace before now
+func (rollup *Rollup) Flush(now time.Time) error {
+	var ended []*bucket
+
+	rollup.lock.Lock()
+	for key, current := range rollup.buckets {
+		if !current.end.Add(RollupGrace).After(now) {
+			ended = append(ended, current)
+			delete(rollup.buckets, key)
+		}
+	}
+	rollup.lock.Unlock()
+
+	if len(ended) == 0 {
+		return nil
+	}
+
+	sort.Sort(byStart(ended))
+
+	points := make([]Point, 0, len(ended))
+	for _, current := range ended {
+		if len(current.fields) == 0 {
+			continue
+		}
+		points = append(points, current.point())
+	}
+
+	if len(points) == 0 {
+		return nil
+	}
+	return rollup.sink.Write(points)
+}
+
+func (current *bucket) point() Point {
+	tags := make(map[string]string, len(current.tags)+1)
+	for key, value := range current.tags {
+		tags[key] = value
+	}
+	tags[RollupTag] = current.end.Sub(current.start).String()
+
+	fields := make(map[string]interface{}, 4*len(current.fields))
+	for field, aggregated := range current.fields {
+		prefix := field + "_"
+		if field == ValueField {
+			prefix = ""
+		}
+		fields[prefix+"min"] = aggregated.min
+		fields[prefix+"max"] = aggregated.max
+		fields[prefix+"avg"] = aggregated.sum / float64(aggregated.count)
+		fields[prefix+"count"] = int64(aggregated.count)
+	}
+
+	return Point{
+		Measurement: current.measurement,
+		Time:        current.start,
+		Tags:        tags,
+		Fields:      fields,
+	}
+}
+
+type byStart []*bucket
+
+func (buckets byStart) Len() int           { return len(buckets) }
+func (buckets byStart) Swap(i, j int)      { buckets[i], buckets[j] = buckets[j], buckets[i] }
+func (buckets byStart) Less(i, j int) bool {
+	if buckets[i].start.Equal(buckets[j].start) {
+		return buckets[i].measurement < buckets[j].measurement
+	}
+	return buckets[i].start.Before(buckets[j].start)
+}
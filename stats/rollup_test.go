@@ -0,0 +1,82 @@
+package stats_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSink struct {
+	lock   sync.Mutex
+	points []stats.Point
+}
+
+func (sink *recordingSink) Write(points []stats.Point) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.points = append(sink.points, points...)
+	return nil
+}
+
+func (sink *recordingSink) written() []stats.Point {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	points := sink.points
+	sink.points = nil
+	return points
+}
+
+func TestRollup(t *testing.T) {
+
+	sink := &recordingSink{}
+	rollup, err := stats.NewRollup(sink, []stats.RollupRule{
+		{Measurement: "*.*.monitor.cpu.*", Forward: stats.ForwardRollup, Window: time.Hour},
+		{Measurement: "disk", Forward: stats.ForwardBoth, Window: time.Hour},
+	})
+	assert.NoError(t, err)
+
+	//windows end in the future so only the explicit flushes write rollups
+	start := time.Now().Truncate(time.Hour)
+	cpu := "1.2.monitor.cpu.percent"
+	point := func(measurement string, offset time.Duration, fields map[string]interface{}) stats.Point {
+		return stats.Point{Measurement: measurement, Time: start.Add(offset), Tags: map[string]string{"gid": "1"}, Fields: fields}
+	}
+
+	assert.NoError(t, rollup.Write([]stats.Point{
+		point(cpu, time.Second, map[string]interface{}{"value": 10.0}),
+		point(cpu, 2*time.Second, map[string]interface{}{"value": 30.0}),
+		point(cpu, 3*time.Second, map[string]interface{}{"value": 20.0}),
+		point("disk", time.Second, map[string]interface{}{"free": int64(5), "mount": "/"}),
+		point("memory", time.Second, map[string]interface{}{"value": 1.0}),
+	}))
+
+	raw := sink.written()
+	assert.Len(t, raw, 2)
+	assert.Equal(t, "disk", raw[0].Measurement)
+	assert.Equal(t, "memory", raw[1].Measurement)
+
+	assert.NoError(t, rollup.Flush(start.Add(time.Hour)))
+	assert.Empty(t, sink.written(), "windows are only flushed after the grace period")
+
+	assert.NoError(t, rollup.Flush(start.Add(time.Hour+stats.RollupGrace)))
+	assert.Equal(t, []stats.Point{
+		{
+			Measurement: cpu,
+			Time:        start,
+			Tags:        map[string]string{"gid": "1", "rollup": "1h0m0s"},
+			Fields:      map[string]interface{}{"min": 10.0, "max": 30.0, "avg": 20.0, "count": int64(3)},
+		},
+		{
+			Measurement: "disk",
+			Time:        start,
+			Tags:        map[string]string{"gid": "1", "rollup": "1h0m0s"},
+			Fields:      map[string]interface{}{"free_min": 5.0, "free_max": 5.0, "free_avg": 5.0, "free_count": int64(1)},
+		},
+	}, sink.written())
+
+	_, err = stats.NewRollup(sink, []stats.RollupRule{{Measurement: "cpu", Forward: stats.ForwardRollup}})
+	assert.Error(t, err, "a rollup without a window")
+}
@@ -0,0 +1,68 @@
+// Agent stats and the sinks they are written to
+package stats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/core"
+)
+
+const (
+	SinkInfluxDB   = "influxdb"
+	SinkPrometheus = "prometheus"
+
+	// The field of the points sent in the legacy series format
+	ValueField = "value"
+)
+
+// The tags every legacy agent stat key is made of, in order
+var Tags = []string{"gid", "nid", "command", "domain", "name", "measurement"}
+
+// A single point of an agent stat, field values are float64, int64, string or bool
+type Point struct {
+	Measurement string
+	Time        time.Time
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	// The authenticated agent that reported the point, unlike the tags it never comes from the payload
+	Agent *core.AgentID
+}
+
+// Sinks store the stats agents report
+type Sink interface {
+	Write(points []Point) error
+}
+
+/*
+Returned by a sink that refuses the points themselves, like malformed ones. Writing them again
+fails the same way, so they are dropped instead of being retried or spooled.
+*/
+type PermanentError struct {
+	Err error
+}
+
+func (err *PermanentError) Error() string {
+	return err.Err.Error()
+}
+
+// Whether a sink refused the points themselves, as opposed to being unavailable
+func IsPermanent(err error) bool {
+	_, ok := err.(*PermanentError)
+	return ok
+}
+
+// Splits a key formated as gid.nid.cmd.domain.name.[measurement] into its tags
+func KeyTags(key string) map[string]string {
+	tags := make(map[string]string)
+	for i, value := range strings.SplitN(key, ".", len(Tags)) {
+		tags[Tags[i]] = value
+	}
+	return tags
+}
+
+// Returned when the sink name in the settings is unknown
+func UnknownSinkError(name string) error {
+	return fmt.Errorf("unknown stats sink %q, expected %s or %s", name, SinkInfluxDB, SinkPrometheus)
+}
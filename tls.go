@@ -3,38 +3,257 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"net/http"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
 	"github.com/amrhassan/agentcontroller2/settings"
 )
 
-func configureClientCertificates(httpBinding settings.HTTPBinding, server *http.Server) (err error) {
+const certificateReloadInterval = 30 * time.Second
+
+/*
+certificateStore holds the TLS configuration of an HTTP binding and swaps it for a freshly
+loaded one on SIGHUP or when any of the certificate, clientCA or CRL files change. A failed
+reload is logged and the previous configuration stays in use.
+*/
+type certificateStore struct {
+	httpBinding settings.HTTPBinding
+	lock        sync.RWMutex
+	config      *tls.Config
+	modTimes    map[string]time.Time
+}
+
+func newCertificateStore(httpBinding settings.HTTPBinding) (*certificateStore, error) {
+	store := &certificateStore{httpBinding: httpBinding}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+//configForClient is meant to be used as tls.Config.GetConfigForClient
+func (store *certificateStore) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.config, nil
+}
+
+func (store *certificateStore) load() error {
+	config := &tls.Config{}
+
+	if err := configureServerCertificates(store.httpBinding, config); err != nil {
+		return err
+	}
+
+	if err := configureClientCertificates(store.httpBinding, config); err != nil {
+		return err
+	}
+
+	modTimes, err := store.currentModTimes()
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.config = config
+	store.modTimes = modTimes
+
+	return nil
+}
+
+func (store *certificateStore) files() []string {
+	var files []string
+	for _, tlsSetting := range store.httpBinding.TLS {
+		files = append(files, tlsSetting.Cert, tlsSetting.Key)
+	}
+	for _, clientCA := range store.httpBinding.ClientCA {
+		files = append(files, clientCA.Cert)
+	}
+	for _, clientCRL := range store.httpBinding.ClientCRL {
+		files = append(files, clientCRL.File)
+	}
+	return files
+}
+
+func (store *certificateStore) currentModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range store.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (store *certificateStore) changed() bool {
+	modTimes, err := store.currentModTimes()
+	if err != nil {
+		//a file being replaced may be missing for a moment, try again on the next tick
+		return false
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	for file, modTime := range modTimes {
+		if !modTime.Equal(store.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+//watch reloads the configuration on SIGHUP or file changes, it never returns
+func (store *certificateStore) watch() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(certificateReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hangup:
+		case <-ticker.C:
+			if !store.changed() {
+				continue
+			}
+		}
+
+		if err := store.load(); err != nil {
+			log.Println("[-] failed to reload certificates for", store.httpBinding.Address, err)
+			continue
+		}
+		log.Println("[+] reloaded certificates for", store.httpBinding.Address)
+	}
+}
+
+func configureClientCertificates(httpBinding settings.HTTPBinding, config *tls.Config) (err error) {
 	if httpBinding.ClientCertificateRequired() {
-		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
-		server.TLSConfig.ClientCAs = x509.NewCertPool()
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = x509.NewCertPool()
+		var authorities []*x509.Certificate
 		for _, clientCA := range httpBinding.ClientCA {
 			certPEM, err := ioutil.ReadFile(clientCA.Cert)
 			if err != nil {
 				return err
 			}
-			ok := server.TLSConfig.ClientCAs.AppendCertsFromPEM(certPEM)
+			ok := config.ClientCAs.AppendCertsFromPEM(certPEM)
 			if !ok {
 				return errors.New("failed to parse clientCA certificate")
 			}
+			certificates, err := parseCertificates(certPEM)
+			if err != nil {
+				return err
+			}
+			authorities = append(authorities, certificates...)
+		}
+
+		revoked, err := loadRevokedCertificates(httpBinding, authorities)
+		if err != nil {
+			return err
+		}
+
+		if len(revoked) > 0 {
+			config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+				for _, chain := range verifiedChains {
+					for _, certificate := range chain {
+						if revoked[revocationKey(certificate.RawIssuer, certificate.SerialNumber.String())] {
+							return fmt.Errorf("client certificate %q has been revoked", certificate.Subject.CommonName)
+						}
+					}
+				}
+				return nil
+			}
 		}
 	}
 	return
 }
 
-func configureServerCertificates(httpBinding settings.HTTPBinding, server *http.Server) (err error) {
-	server.TLSConfig.Certificates = make([]tls.Certificate, len(httpBinding.TLS), len(httpBinding.TLS))
+func configureServerCertificates(httpBinding settings.HTTPBinding, config *tls.Config) (err error) {
+	config.Certificates = make([]tls.Certificate, len(httpBinding.TLS), len(httpBinding.TLS))
 	for certificateIndex, tlsSetting := range httpBinding.TLS {
 		certificate, err := tls.LoadX509KeyPair(tlsSetting.Cert, tlsSetting.Key)
 		if err != nil {
 			return err
 		}
-		server.TLSConfig.Certificates[certificateIndex] = certificate
+		config.Certificates[certificateIndex] = certificate
 	}
 	return
 }
+
+//loadRevokedCertificates reads the CRL's of a binding, each must be signed by one of the clientCA's
+func loadRevokedCertificates(httpBinding settings.HTTPBinding, authorities []*x509.Certificate) (map[string]bool, error) {
+	revoked := make(map[string]bool)
+
+	for _, clientCRL := range httpBinding.ClientCRL {
+		data, err := ioutil.ReadFile(clientCRL.File)
+		if err != nil {
+			return nil, err
+		}
+
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+
+		crl, err := x509.ParseCRL(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CRL %s: %v", clientCRL.File, err)
+		}
+
+		//the revoked certificates are those the signing clientCA issued
+		var issuer *x509.Certificate
+		for _, authority := range authorities {
+			if authority.CheckCRLSignature(crl) == nil {
+				issuer = authority
+				break
+			}
+		}
+		if issuer == nil {
+			return nil, fmt.Errorf("CRL %s is not signed by any of the clientCA's", clientCRL.File)
+		}
+
+		if crl.HasExpired(time.Now()) {
+			log.Println("[-] CRL", clientCRL.File, "is past its next update time")
+		}
+
+		for _, entry := range crl.TBSCertList.RevokedCertificates {
+			revoked[revocationKey(issuer.RawSubject, entry.SerialNumber.String())] = true
+		}
+	}
+
+	return revoked, nil
+}
+
+func revocationKey(rawIssuer []byte, serial string) string {
+	return string(rawIssuer) + "/" + serial
+}
+
+func parseCertificates(certPEM []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return certificates, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amrhassan/agentcontroller2/settings"
+	"github.com/stretchr/testify/assert"
+)
+
+type testAuthority struct {
+	key         *rsa.PrivateKey
+	certificate *x509.Certificate
+}
+
+func newTestAuthority(t *testing.T, name string) *testAuthority {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &testAuthority{key: key, certificate: certificate}
+}
+
+//issue signs a certificate for name, usable both as a server and a client certificate
+func (authority *testAuthority) issue(t *testing.T, name string, serial int64) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, authority.certificate, &key.PublicKey, authority.key)
+	assert.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return certificate, key
+}
+
+func (authority *testAuthority) crl(t *testing.T, serials ...int64) []byte {
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := authority.certificate.CreateCRL(rand.Reader, authority.key, revoked, time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func writePEM(t *testing.T, path string, kind string, der []byte) {
+	assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600))
+}
+
+//testBinding writes the files of a TLS binding with a server certificate, a clientCA and a CRL
+func testBinding(t *testing.T, dir string, authority *testAuthority, crl []byte) settings.HTTPBinding {
+	server, key := authority.issue(t, "localhost", 100)
+	writePEM(t, filepath.Join(dir, "server.crt"), "CERTIFICATE", server.Raw)
+	writePEM(t, filepath.Join(dir, "server.key"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	writePEM(t, filepath.Join(dir, "ca.crt"), "CERTIFICATE", authority.certificate.Raw)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ca.crl"), crl, 0600))
+
+	binding := settings.HTTPBinding{Address: ":0"}
+	binding.TLS = append(binding.TLS, struct {
+		Cert string
+		Key  string
+	}{filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")})
+	binding.ClientCA = append(binding.ClientCA, struct{ Cert string }{filepath.Join(dir, "ca.crt")})
+	binding.ClientCRL = append(binding.ClientCRL, struct{ File string }{filepath.Join(dir, "ca.crl")})
+	return binding
+}
+
+func TestLoadRevokedCertificates(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	authority := newTestAuthority(t, "agents")
+	binding := testBinding(t, dir, authority, authority.crl(t, 7))
+
+	revoked, err := loadRevokedCertificates(binding, []*x509.Certificate{authority.certificate})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{revocationKey(authority.certificate.RawSubject, "7"): true}, revoked)
+
+	//a CRL is only trusted from one of the clientCA's
+	other := newTestAuthority(t, "others")
+	_, err = loadRevokedCertificates(binding, []*x509.Certificate{other.certificate})
+	assert.Error(t, err)
+}
+
+func TestRevokedClientCertificateIsRefused(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	authority := newTestAuthority(t, "agents")
+	binding := testBinding(t, dir, authority, authority.crl(t, 7))
+
+	store, err := newCertificateStore(binding)
+	assert.NoError(t, err)
+
+	revoked, _ := authority.issue(t, "1-2", 7)
+	valid, _ := authority.issue(t, "1-3", 8)
+
+	config, err := store.configForClient(nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, config.VerifyPeerCertificate) {
+		assert.Error(t, config.VerifyPeerCertificate(nil, [][]*x509.Certificate{{revoked, authority.certificate}}))
+		assert.NoError(t, config.VerifyPeerCertificate(nil, [][]*x509.Certificate{{valid, authority.certificate}}))
+	}
+
+	//a new CRL is picked up once its file changes
+	crlFile := filepath.Join(dir, "ca.crl")
+	assert.NoError(t, ioutil.WriteFile(crlFile, authority.crl(t, 7, 8), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(crlFile, later, later))
+
+	assert.True(t, store.changed())
+	assert.NoError(t, store.load())
+	assert.False(t, store.changed())
+
+	config, err = store.configForClient(nil)
+	assert.NoError(t, err)
+	assert.Error(t, config.VerifyPeerCertificate(nil, [][]*x509.Certificate{{valid, authority.certificate}}))
+
+	//a broken CRL keeps the previous configuration in use
+	assert.NoError(t, ioutil.WriteFile(crlFile, []byte("garbage"), 0600))
+	assert.Error(t, store.load())
+	current, _ := store.configForClient(nil)
+	assert.Equal(t, config, current)
+}